@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+	"io"
+)
+
+// contextReader stops reading from r once ctx is done
+type contextReader struct {
+	ctx context.Context
+	r io.Reader
+}
+
+func (cr contextReader) Read (b []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(b)
+}
+
+// closeOnDone closes c as soon as ctx is done, which unblocks any
+// reader or writer waiting on it. The returned func stops it.
+func closeOnDone (ctx context.Context, c io.Closer) func () bool {
+	return context.AfterFunc(ctx, func () {
+		c.Close()
+	})
+}
@@ -2,6 +2,8 @@ package crypto
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"path/filepath"
 	"testing"
 )
 
@@ -29,3 +31,21 @@ func TestCopyEncryptDecrypt (t *testing.T) {
 		t.Errorf("decryption failed!")
 	}
 }
+
+func TestLoadOrCreateIdentityKey (t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identity.key")
+	key, err := LoadOrCreateIdentityKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadOrCreateIdentityKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.Equal(loaded) {
+		t.Errorf("expected the stored identity key to be loaded")
+	}
+	if IDFromPublicKey(key.Public().(ed25519.PublicKey)) != IDFromPublicKey(loaded.Public().(ed25519.PublicKey)) {
+		t.Errorf("expected the same ID for the same key")
+	}
+}
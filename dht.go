@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/priyangshupal/distributed-file-system/crypto"
+	"github.com/priyangshupal/distributed-file-system/dht"
+	"github.com/priyangshupal/distributed-file-system/p2p"
+	"github.com/priyangshupal/distributed-file-system/store"
+)
+
+const (
+	defaultDHTRefreshInterval = time.Minute * 10
+	// defaultRepublishInterval is how often the files held locally
+	// are announced again, well before their records expire
+	defaultRepublishInterval = dht.DefaultProviderTTL / 2
+)
+
+// MessageFindNode asks for the nodes closest to Target
+type MessageFindNode struct {
+	Target dht.ID
+}
+
+type MessageFindNodeResponse struct {
+	Contacts []dht.Contact
+	Err string
+}
+
+// MessageFindValue asks for the providers of Key the receiver
+// knows and the nodes closest to it
+type MessageFindValue struct {
+	Key dht.ID
+}
+
+type MessageFindValueResponse struct {
+	Providers []dht.Contact
+	Closer []dht.Contact
+	Err string
+}
+
+// MessageAddProvider stores provider records for Key on the receiver
+type MessageAddProvider struct {
+	Key dht.ID
+	Providers []dht.Contact
+}
+
+type MessageAddProviderResponse struct {
+	Err string
+}
+
+// nodeID maps the ID of a node into the key space of the DHT. IDs
+// derived from identity keys are used as they are.
+func nodeID (id string) dht.ID {
+	if nid, err := dht.ParseID(id); err == nil {
+		return nid
+	}
+	return dht.KeyID(id)
+}
+
+// fileID is the key of the provider records of the file of the
+// node id, by its hashed key
+func fileID (id string, hashedKey string) dht.ID {
+	return dht.KeyID(id + "/" + hashedKey)
+}
+
+func peerContact (p p2p.Peer) dht.Contact {
+	return dht.Contact{ID: nodeID(p.ID()), Addr: p.Info().ListenAddr}
+}
+
+// dhtNetwork sends the RPCs of the DHT as requests to the peers,
+// connecting to the nodes that are not peers yet
+type dhtNetwork struct {
+	s *FileServer
+}
+
+func (n dhtNetwork) FindNode (ctx context.Context, to dht.Contact, target dht.ID) ([]dht.Contact, error) {
+	resp, err := n.s.call(ctx, to, MessageFindNode{Target: target})
+	if err != nil {
+		return nil, err
+	}
+	v, ok := resp.(MessageFindNodeResponse)
+	if !ok {
+		return nil, fmt.Errorf("unexpected response %T to find node", resp)
+	}
+	return v.Contacts, nil
+}
+
+func (n dhtNetwork) FindValue (ctx context.Context, to dht.Contact, key dht.ID) ([]dht.Contact, []dht.Contact, error) {
+	resp, err := n.s.call(ctx, to, MessageFindValue{Key: key})
+	if err != nil {
+		return nil, nil, err
+	}
+	v, ok := resp.(MessageFindValueResponse)
+	if !ok {
+		return nil, nil, fmt.Errorf("unexpected response %T to find value", resp)
+	}
+	return v.Providers, v.Closer, nil
+}
+
+func (n dhtNetwork) AddProvider (ctx context.Context, to dht.Contact, key dht.ID, providers []dht.Contact) error {
+	_, err := n.s.call(ctx, to, MessageAddProvider{Key: key, Providers: providers})
+	return err
+}
+
+// call sends a request to the node and waits for its response
+func (s *FileServer) call (ctx context.Context, to dht.Contact, payload any) (any, error) {
+	peer, release, err := s.connect(ctx, to)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	req := s.newRequest(ctx, 1)
+	defer s.finishRequest(req)
+	if err := s.send(peer, &Message{RequestID: req.id, Payload: payload}); err != nil {
+		return nil, err
+	}
+	responses, err := s.awaitResponses(ctx, req, []string{peer.ID()})
+	if err != nil {
+		return nil, err
+	}
+	resp := responses[peer.ID()]
+	if err := responseErr(resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// lookupConn is a connection dialed only for the DHT
+type lookupConn struct {
+	users int
+}
+
+// connect returns the peer of the node, connecting to it if we are
+// not connected with it yet. The node is dialed by the connection
+// manager, so it is never dialed twice when peer exchange learns
+// about it at the same time. A connection dialed only for the DHT is
+// not kept, the last caller calling release closes it.
+func (s *FileServer) connect (ctx context.Context, c dht.Contact) (p2p.Peer, func (), error) {
+	id := c.ID.String()
+	release := func () {}
+	s.lookupLock.Lock()
+	lc, ok := s.lookupConns[c.Addr]
+	if !ok {
+		if peer, ok := s.peers.get(id); ok {
+			s.lookupLock.Unlock()
+			return peer, release, nil
+		}
+	}
+	// nodes the connection manager keeps anyway are not released
+	if !ok && s.connMgr.Add(c.Addr) {
+		lc = &lookupConn{}
+		s.lookupConns[c.Addr] = lc
+	}
+	if lc != nil {
+		lc.users++
+		release = sync.OnceFunc(func () {
+			s.releaseConn(c.Addr, id, lc)
+		})
+	}
+	s.lookupLock.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, s.RequestTimeout)
+	defer cancel()
+	peer, err := s.peers.wait(ctx, id)
+	if err != nil {
+		release()
+		return nil, nil, fmt.Errorf("[%s] connecting to %s (%s): %w", s.Transport.Addr(), c.Addr, id, err)
+	}
+	return peer, release, nil
+}
+
+// releaseConn stops keeping the connection dialed for the DHT once
+// nobody uses it anymore, and closes it
+func (s *FileServer) releaseConn (addr string, id string, lc *lookupConn) {
+	s.lookupLock.Lock()
+	defer s.lookupLock.Unlock()
+	// the connection is kept, see keepConn
+	if s.lookupConns[addr] != lc {
+		return
+	}
+	if lc.users > 1 {
+		lc.users--
+		return
+	}
+	delete(s.lookupConns, addr)
+	s.connMgr.Remove(addr)
+	// a connection the node dialed itself meanwhile is its own
+	if peer, ok := s.peers.get(id); ok && peer.Outbound() {
+		peer.Close()
+	}
+}
+
+// keepConn keeps the connection with the node listening on addr,
+// even if it has been dialed only for the DHT. The node dialed us as
+// well, and both of us may settle on our connection.
+func (s *FileServer) keepConn (addr string) {
+	s.lookupLock.Lock()
+	defer s.lookupLock.Unlock()
+	delete(s.lookupConns, addr)
+}
+
+// provide announces in the background that the local node holds the
+// file of the node id, by its hashed key
+func (s *FileServer) provide (id string, hashedKey string) {
+	s.goOp(func (ctx context.Context) {
+		if err := s.dht.Provide(ctx, fileID(id, hashedKey)); err != nil {
+			log.Printf("[%s] announcing file (%s) failed: %v", s.Transport.Addr(), hashedKey, err)
+		}
+	})
+}
+
+// findProviders returns the peers that announced to hold the file,
+// other than the ones in skip. release closes the connections dialed
+// to reach them.
+func (s *FileServer) findProviders (ctx context.Context, key string, skip map[string]p2p.Peer) (map[string]p2p.Peer, func (), error) {
+	var releases []func ()
+	release := func () {
+		for _, r := range releases {
+			r()
+		}
+	}
+	contacts, err := s.dht.FindProviders(ctx, fileID(s.ID, crypto.HashKey(key)))
+	if err != nil {
+		return nil, release, err
+	}
+	peers := make(map[string]p2p.Peer)
+	for _, c := range contacts {
+		id := c.ID.String()
+		if _, ok := skip[id]; ok || id == s.ID {
+			continue
+		}
+		peer, r, err := s.connect(ctx, c)
+		if err != nil {
+			log.Printf("[%s] %v", s.Transport.Addr(), err)
+			continue
+		}
+		releases = append(releases, r)
+		peers[id] = peer
+	}
+	return peers, release, nil
+}
+
+// dhtLoop looks up the local node every now and then, which keeps
+// the routing table fresh and drops expired provider records. The
+// files held locally are announced again before their provider
+// records expire.
+func (s *FileServer) dhtLoop () {
+	defer s.routines.Done()
+	refresh := time.NewTicker(defaultDHTRefreshInterval)
+	defer refresh.Stop()
+	republish := time.NewTicker(defaultRepublishInterval)
+	defer republish.Stop()
+	for {
+		select {
+		case <- refresh.C:
+			s.refreshDHT()
+		case <- republish.C:
+			s.goOp(func (ctx context.Context) {
+				if err := s.republish(ctx); err != nil {
+					log.Printf("[%s] announcing the local files again failed: %v", s.Transport.Addr(), err)
+				}
+			})
+		case <- s.quitch:
+			return
+		}
+	}
+}
+
+// republish announces every file held locally again
+func (s *FileServer) republish (ctx context.Context) error {
+	return s.store.Walk(func (meta store.Meta) error {
+		hashedKey := meta.Key
+		// the owner keeps its files under their plain key
+		if meta.ID == s.ID {
+			hashedKey = crypto.HashKey(meta.Key)
+		}
+		if err := s.dht.Provide(ctx, fileID(meta.ID, hashedKey)); err != nil {
+			log.Printf("[%s] announcing file (%s) failed: %v", s.Transport.Addr(), hashedKey, err)
+		}
+		return ctx.Err()
+	})
+}
+
+func (s *FileServer) refreshDHT () {
+	s.goOp(func (ctx context.Context) {
+		if err := s.dht.Bootstrap(ctx); err != nil {
+			log.Printf("[%s] refreshing the routing table failed: %v", s.Transport.Addr(), err)
+		}
+	})
+}
+
+func (s *FileServer) handleMessageFindNode (from string, requestID uint64, msg MessageFindNode) error {
+	peer, ok := s.peers.get(from)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+	contacts := s.dht.HandleFindNode(peerContact(peer), msg.Target)
+	return s.reply(peer, requestID, MessageFindNodeResponse{Contacts: contacts})
+}
+
+func (s *FileServer) handleMessageFindValue (from string, requestID uint64, msg MessageFindValue) error {
+	peer, ok := s.peers.get(from)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+	providers, closer := s.dht.HandleFindValue(peerContact(peer), msg.Key)
+	return s.reply(peer, requestID, MessageFindValueResponse{Providers: providers, Closer: closer})
+}
+
+func (s *FileServer) handleMessageAddProvider (from string, requestID uint64, msg MessageAddProvider) error {
+	peer, ok := s.peers.get(from)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+	// the address the sender announces for itself may be something
+	// like ":3000", the one from the handshake can be dialed
+	contact := peerContact(peer)
+	for i, p := range msg.Providers {
+		if p.ID == contact.ID {
+			msg.Providers[i] = contact
+		}
+	}
+	s.dht.HandleAddProvider(contact, msg.Key, msg.Providers)
+	return s.reply(peer, requestID, MessageAddProviderResponse{})
+}
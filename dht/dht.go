@@ -0,0 +1,324 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultK is the size of the k-buckets and the number of nodes
+	// a lookup converges on
+	DefaultK = 20
+	// DefaultAlpha is the number of queries a lookup runs in parallel
+	DefaultAlpha = 3
+	DefaultProviderTTL = time.Hour * 24
+)
+
+var ErrNoContacts = errors.New("no contacts in the routing table")
+
+// Network sends the RPCs of the DHT to other nodes. Errors mean that
+// the node could not be reached and drop it from the routing table.
+type Network interface {
+	FindNode (ctx context.Context, to Contact, target ID) ([]Contact, error)
+	// FindValue returns the providers of the key known to the node
+	// and the contacts closest to the key
+	FindValue (ctx context.Context, to Contact, key ID) (providers []Contact, closer []Contact, err error)
+	AddProvider (ctx context.Context, to Contact, key ID, providers []Contact) error
+}
+
+type Opts struct {
+	Self Contact
+	Network Network
+	// K is the size of the buckets, DefaultK when zero
+	K int
+	// Alpha is the parallelism of lookups, DefaultAlpha when zero
+	Alpha int
+	// ProviderTTL is how long provider records are kept,
+	// DefaultProviderTTL when zero
+	ProviderTTL time.Duration
+}
+
+// DHT is a Kademlia distributed hash table. It finds the nodes closest
+// to a key by XOR distance in O(log n) hops, and stores provider
+// records on them, telling who holds the data of the key.
+type DHT struct {
+	Opts
+
+	table *routingTable
+
+	mu sync.Mutex
+	providers map[ID]map[ID]providerRecord
+}
+
+type providerRecord struct {
+	contact Contact
+	expires time.Time
+}
+
+func New (opts Opts) *DHT {
+	if opts.K == 0 { opts.K = DefaultK }
+	if opts.Alpha == 0 { opts.Alpha = DefaultAlpha }
+	if opts.ProviderTTL == 0 { opts.ProviderTTL = DefaultProviderTTL }
+	return &DHT{
+		Opts: opts,
+		table: newRoutingTable(opts.Self.ID, opts.K),
+		providers: make(map[ID]map[ID]providerRecord),
+	}
+}
+
+// Update records that the node is alive, e.g. because it connected
+func (d *DHT) Update (c Contact) {
+	if len(c.Addr) > 0 {
+		d.table.update(c)
+	}
+}
+
+// Remove drops the node from the routing table
+func (d *DHT) Remove (id ID) {
+	d.table.remove(id)
+}
+
+// Len returns the number of contacts in the routing table
+func (d *DHT) Len () int {
+	return d.table.len()
+}
+
+// Bootstrap looks up the local ID, which fills the buckets with the
+// nodes close to the local node and announces it to them. It is run
+// once some contacts are known and then every now and then.
+func (d *DHT) Bootstrap (ctx context.Context) error {
+	d.expireProviders()
+	_, err := d.FindNode(ctx, d.Self.ID)
+	return err
+}
+
+// FindNode returns the K nodes closest to the target
+func (d *DHT) FindNode (ctx context.Context, target ID) ([]Contact, error) {
+	closest, _, err := d.lookup(ctx, target, false)
+	return closest, err
+}
+
+// FindProviders returns the nodes that announced to hold the data
+// of the key. Every node only knows the records that reached it, so
+// the records of the K nodes closest to the key are merged with the
+// local ones.
+func (d *DHT) FindProviders (ctx context.Context, key ID) ([]Contact, error) {
+	local := d.localProviders(key)
+	_, providers, err := d.lookup(ctx, key, true)
+	if errors.Is(err, ErrNoContacts) {
+		return local, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range local {
+		if indexOf(providers, p.ID) < 0 {
+			providers = append(providers, p)
+		}
+	}
+	return providers, nil
+}
+
+// Provide stores provider records for the key on the K nodes closest
+// to it. The local node is used when no providers are given. The
+// local node keeps no record about itself, the other nodes know its
+// address better.
+func (d *DHT) Provide (ctx context.Context, key ID, providers ...Contact) error {
+	if len(providers) == 0 {
+		providers = []Contact{d.Self}
+	}
+	others := []Contact{}
+	for _, p := range providers {
+		if p.ID != d.Self.ID {
+			others = append(others, p)
+		}
+	}
+	d.addProviders(key, others)
+	closest, _, err := d.lookup(ctx, key, false)
+	if err != nil {
+		if errors.Is(err, ErrNoContacts) {
+			return nil
+		}
+		return err
+	}
+
+	errs := make(chan error, len(closest))
+	for _, c := range closest {
+		go func (c Contact) {
+			errs <- d.Network.AddProvider(ctx, c, key, providers)
+		}(c)
+	}
+	var failed []error
+	for range closest {
+		if err := <- errs; err != nil {
+			failed = append(failed, err)
+		}
+	}
+	if len(failed) > 0 && len(failed) == len(closest) {
+		return errors.Join(failed...)
+	}
+	return nil
+}
+
+// HandleFindNode answers a FIND_NODE request of the node from
+func (d *DHT) HandleFindNode (from Contact, target ID) []Contact {
+	d.Update(from)
+	return d.table.closest(target, d.K)
+}
+
+// HandleFindValue answers a FIND_VALUE request of the node from with
+// the providers it knows and the closest contacts, so the lookup can
+// go on to the nodes that know the others
+func (d *DHT) HandleFindValue (from Contact, key ID) ([]Contact, []Contact) {
+	d.Update(from)
+	return d.localProviders(key), d.table.closest(key, d.K)
+}
+
+// HandleAddProvider stores the provider records sent by the node from
+func (d *DHT) HandleAddProvider (from Contact, key ID, providers []Contact) {
+	d.Update(from)
+	d.addProviders(key, providers)
+}
+
+type lookupResult struct {
+	from Contact
+	providers []Contact
+	closer []Contact
+	err error
+}
+
+// lookup queries the closest known nodes for the target, Alpha at a
+// time, and moves on to the closer nodes they return until the K
+// closest nodes seen have all answered. With findValue it also
+// collects the providers every one of them knows.
+func (d *DHT) lookup (ctx context.Context, target ID, findValue bool) ([]Contact, []Contact, error) {
+	shortlist := d.table.closest(target, d.K)
+	if len(shortlist) == 0 {
+		return nil, nil, ErrNoContacts
+	}
+	seen := map[ID]bool{d.Self.ID: true}
+	for _, c := range shortlist {
+		seen[c.ID] = true
+	}
+	queried := make(map[ID]bool)
+	providers := make(map[ID]Contact)
+
+	for {
+		batch := []Contact{}
+		for i := 0; i < len(shortlist) && i < d.K && len(batch) < d.Alpha; i++ {
+			if !queried[shortlist[i].ID] {
+				batch = append(batch, shortlist[i])
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		results := make(chan lookupResult, len(batch))
+		for _, c := range batch {
+			queried[c.ID] = true
+			go func (c Contact) {
+				results <- d.query(ctx, c, target, findValue)
+			}(c)
+		}
+		failed := make(map[ID]bool)
+		for range batch {
+			r := <- results
+			if r.err != nil {
+				failed[r.from.ID] = true
+				continue
+			}
+			d.table.update(r.from)
+			for _, p := range r.providers {
+				providers[p.ID] = p
+			}
+			for _, c := range r.closer {
+				if !seen[c.ID] && len(c.Addr) > 0 {
+					seen[c.ID] = true
+					shortlist = append(shortlist, c)
+				}
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		// nodes that did not answer are dropped, not just from
+		// this lookup
+		alive := shortlist[:0]
+		for _, c := range shortlist {
+			if failed[c.ID] {
+				d.table.remove(c.ID)
+				continue
+			}
+			alive = append(alive, c)
+		}
+		shortlist = alive
+		sortByDistance(target, shortlist)
+	}
+
+	if len(shortlist) > d.K {
+		shortlist = shortlist[:d.K]
+	}
+	found := make([]Contact, 0, len(providers))
+	for _, p := range providers {
+		found = append(found, p)
+	}
+	return shortlist, found, nil
+}
+
+func (d *DHT) query (ctx context.Context, to Contact, target ID, findValue bool) lookupResult {
+	r := lookupResult{from: to}
+	if findValue {
+		r.providers, r.closer, r.err = d.Network.FindValue(ctx, to, target)
+	} else {
+		r.closer, r.err = d.Network.FindNode(ctx, to, target)
+	}
+	return r
+}
+
+func (d *DHT) addProviders (key ID, providers []Contact) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	records, ok := d.providers[key]
+	if !ok {
+		records = make(map[ID]providerRecord)
+		d.providers[key] = records
+	}
+	expires := time.Now().Add(d.ProviderTTL)
+	for _, p := range providers {
+		records[p.ID] = providerRecord{contact: p, expires: expires}
+	}
+}
+
+func (d *DHT) localProviders (key ID) []Contact {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	providers := []Contact{}
+	for id, rec := range d.providers[key] {
+		if now.After(rec.expires) {
+			delete(d.providers[key], id)
+			continue
+		}
+		providers = append(providers, rec.contact)
+	}
+	return providers
+}
+
+func (d *DHT) expireProviders () {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	for key, records := range d.providers {
+		for id, rec := range records {
+			if now.After(rec.expires) {
+				delete(records, id)
+			}
+		}
+		if len(records) == 0 {
+			delete(d.providers, key)
+		}
+	}
+}
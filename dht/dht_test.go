@@ -0,0 +1,186 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeNetwork delivers the RPCs by calling the handlers of the
+// nodes directly and counts them
+type fakeNetwork struct {
+	mu sync.Mutex
+	nodes map[ID]*DHT
+	down map[ID]bool
+	calls atomic.Int64
+}
+
+func newFakeNetwork () *fakeNetwork {
+	return &fakeNetwork{nodes: make(map[ID]*DHT), down: make(map[ID]bool)}
+}
+
+func (n *fakeNetwork) node (to Contact) (*DHT, error) {
+	n.calls.Add(1)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	d, ok := n.nodes[to.ID]
+	if !ok || n.down[to.ID] {
+		return nil, errors.New("unreachable")
+	}
+	return d, nil
+}
+
+func (n *fakeNetwork) setDown (id ID) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.down[id] = true
+}
+
+func (n *fakeNetwork) add (d *DHT) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.nodes[d.Self.ID] = d
+}
+
+// from is looked up by the caller, so every node gets its own view
+type fakeEndpoint struct {
+	*fakeNetwork
+	self Contact
+}
+
+func (e fakeEndpoint) FindNode (ctx context.Context, to Contact, target ID) ([]Contact, error) {
+	d, err := e.node(to)
+	if err != nil {
+		return nil, err
+	}
+	return d.HandleFindNode(e.self, target), nil
+}
+
+func (e fakeEndpoint) FindValue (ctx context.Context, to Contact, key ID) ([]Contact, []Contact, error) {
+	d, err := e.node(to)
+	if err != nil {
+		return nil, nil, err
+	}
+	providers, closer := d.HandleFindValue(e.self, key)
+	return providers, closer, nil
+}
+
+func (e fakeEndpoint) AddProvider (ctx context.Context, to Contact, key ID, providers []Contact) error {
+	d, err := e.node(to)
+	if err != nil {
+		return err
+	}
+	d.HandleAddProvider(e.self, key, providers)
+	return nil
+}
+
+// newFakeMesh starts n nodes, every node bootstraps from the first one
+func newFakeMesh (t *testing.T, n int) (*fakeNetwork, []*DHT) {
+	network := newFakeNetwork()
+	nodes := make([]*DHT, n)
+	for i := range nodes {
+		self := Contact{ID: KeyID(fmt.Sprintf("node%d", i)), Addr: fmt.Sprintf("node%d", i)}
+		nodes[i] = New(Opts{Self: self, Network: fakeEndpoint{network, self}})
+		network.add(nodes[i])
+	}
+	for _, d := range nodes[1:] {
+		d.Update(nodes[0].Self)
+		assert.Nil(t, d.Bootstrap(context.Background()))
+	}
+	return network, nodes
+}
+
+func TestFindNode (t *testing.T) {
+	network, nodes := newFakeMesh(t, 200)
+	target := KeyID("target")
+
+	// the exact answer, by sorting all the nodes
+	all := make([]Contact, len(nodes))
+	for i, d := range nodes {
+		all[i] = d.Self
+	}
+	sortByDistance(target, all)
+
+	network.calls.Store(0)
+	closest, err := nodes[len(nodes) - 1].FindNode(context.Background(), target)
+	assert.Nil(t, err)
+	assert.Len(t, closest, DefaultK)
+	assert.Equal(t, all[0], closest[0])
+	// the lookup must not ask every node
+	assert.Less(t, network.calls.Load(), int64(len(nodes) / 2))
+}
+
+func TestProviders (t *testing.T) {
+	network, nodes := newFakeMesh(t, 100)
+	key := KeyID("picture.png")
+	provider := nodes[10]
+	assert.Nil(t, provider.Provide(context.Background(), key))
+
+	network.calls.Store(0)
+	providers, err := nodes[50].FindProviders(context.Background(), key)
+	assert.Nil(t, err)
+	assert.Equal(t, []Contact{provider.Self}, providers)
+	assert.Less(t, network.calls.Load(), int64(len(nodes) / 4))
+
+	providers, err = nodes[60].FindProviders(context.Background(), KeyID("unknown"))
+	assert.Nil(t, err)
+	assert.Empty(t, providers)
+}
+
+func TestProvidersMergesPartialRecords (t *testing.T) {
+	_, nodes := newFakeMesh(t, 50)
+	key := KeyID("picture.png")
+	// every closest node only got the record of one provider, as
+	// if the other announcements were lost
+	closest, err := nodes[0].FindNode(context.Background(), key)
+	assert.Nil(t, err)
+	providers := []Contact{nodes[1].Self, nodes[2].Self, nodes[3].Self}
+	for i, c := range closest {
+		for _, d := range nodes {
+			if d.Self.ID == c.ID {
+				d.HandleAddProvider(nodes[0].Self, key, providers[i % len(providers):i % len(providers) + 1])
+			}
+		}
+	}
+
+	found, err := nodes[40].FindProviders(context.Background(), key)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, providers, found)
+}
+
+func TestLookupDropsUnreachableNodes (t *testing.T) {
+	network, nodes := newFakeMesh(t, 50)
+	d := nodes[0]
+	dead := d.table.closest(d.Self.ID, 1)[0]
+	network.setDown(dead.ID)
+
+	closest, err := d.FindNode(context.Background(), dead.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, -1, indexOf(closest, dead.ID))
+	assert.Equal(t, -1, indexOf(d.table.closest(dead.ID, d.Len()), dead.ID))
+}
+
+func TestRoutingTableReplacements (t *testing.T) {
+	self := ID{}
+	table := newRoutingTable(self, 2)
+	// all of these share no prefix bits with self and land in the
+	// same bucket
+	contacts := make([]Contact, 3)
+	for i := range contacts {
+		contacts[i].ID[0] = 0x80
+		contacts[i].ID[IDSize - 1] = byte(i)
+		contacts[i].Addr = fmt.Sprint(i)
+		table.update(contacts[i])
+	}
+	assert.Equal(t, contacts[:2], table.buckets[0].contacts)
+	assert.Equal(t, contacts[2:], table.buckets[0].replacements)
+
+	table.remove(contacts[0].ID)
+	assert.Equal(t, []Contact{contacts[1], contacts[2]}, table.buckets[0].contacts)
+	assert.Empty(t, table.buckets[0].replacements)
+}
@@ -0,0 +1,72 @@
+package dht
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+)
+
+// IDSize is the size of node IDs and keys in bytes
+const IDSize = 32
+
+// ID is a point in the key space of the DHT. Node IDs are the hex
+// decoded IDs of the nodes, keys are mapped into the same space
+// with KeyID.
+type ID [IDSize]byte
+
+// ParseID decodes a hex encoded node ID, as derived from the
+// identity key of a node
+func ParseID (s string) (ID, error) {
+	var id ID
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return id, err
+	}
+	if len(b) != IDSize {
+		return id, fmt.Errorf("node ID has %d bytes, expected %d", len(b), IDSize)
+	}
+	copy(id[:], b)
+	return id, nil
+}
+
+// KeyID maps a key, usually hashed with crypto.HashKey already,
+// into the key space of the DHT
+func KeyID (key string) ID {
+	return ID(sha256.Sum256([]byte(key)))
+}
+
+func (id ID) String () string {
+	return hex.EncodeToString(id[:])
+}
+
+// Distance returns the XOR distance between two IDs
+func (id ID) Distance (other ID) ID {
+	var d ID
+	for i := range id {
+		d[i] = id[i] ^ other[i]
+	}
+	return d
+}
+
+// closer reports whether a is closer to the target than b
+func closer (target, a, b ID) bool {
+	for i := range target {
+		da, db := a[i] ^ target[i], b[i] ^ target[i]
+		if da != db {
+			return da < db
+		}
+	}
+	return false
+}
+
+// commonPrefixLen returns the number of leading bits the IDs
+// have in common
+func commonPrefixLen (a, b ID) int {
+	for i := range a {
+		if x := a[i] ^ b[i]; x != 0 {
+			return i * 8 + bits.LeadingZeros8(x)
+		}
+	}
+	return IDSize * 8
+}
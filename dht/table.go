@@ -0,0 +1,131 @@
+package dht
+
+import (
+	"sort"
+	"sync"
+)
+
+// Contact is a node of the DHT and the address it can be dialed on
+type Contact struct {
+	ID ID
+	Addr string
+}
+
+// bucket holds the contacts whose IDs share the same number of
+// leading bits with the local ID, least recently seen first. Nodes
+// that don't fit are kept as replacements for contacts that fail.
+type bucket struct {
+	contacts []Contact
+	replacements []Contact
+}
+
+// routingTable is the set of k-buckets of the local node
+type routingTable struct {
+	self ID
+	k int
+
+	mu sync.Mutex
+	buckets [IDSize * 8]bucket
+}
+
+func newRoutingTable (self ID, k int) *routingTable {
+	return &routingTable{self: self, k: k}
+}
+
+func (t *routingTable) bucket (id ID) *bucket {
+	i := commonPrefixLen(t.self, id)
+	if i == len(t.buckets) {
+		return nil
+	}
+	return &t.buckets[i]
+}
+
+// update records that the node has been seen. Contacts that have
+// been alive for long are preferred, so a new node only gets into
+// a full bucket when one of the contacts fails.
+func (t *routingTable) update (c Contact) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := t.bucket(c.ID)
+	if b == nil {
+		return
+	}
+	if i := indexOf(b.contacts, c.ID); i >= 0 {
+		b.contacts = append(append(b.contacts[:i], b.contacts[i + 1:]...), c)
+		return
+	}
+	if len(b.contacts) < t.k {
+		b.contacts = append(b.contacts, c)
+		return
+	}
+	if i := indexOf(b.replacements, c.ID); i >= 0 {
+		b.replacements = append(b.replacements[:i], b.replacements[i + 1:]...)
+	}
+	b.replacements = append(b.replacements, c)
+	if len(b.replacements) > t.k {
+		b.replacements = b.replacements[1:]
+	}
+}
+
+// remove drops a contact that failed to answer and promotes the
+// most recently seen replacement
+func (t *routingTable) remove (id ID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := t.bucket(id)
+	if b == nil {
+		return
+	}
+	if i := indexOf(b.replacements, id); i >= 0 {
+		b.replacements = append(b.replacements[:i], b.replacements[i + 1:]...)
+	}
+	i := indexOf(b.contacts, id)
+	if i < 0 {
+		return
+	}
+	b.contacts = append(b.contacts[:i], b.contacts[i + 1:]...)
+	if n := len(b.replacements); n > 0 {
+		b.contacts = append(b.contacts, b.replacements[n - 1])
+		b.replacements = b.replacements[:n - 1]
+	}
+}
+
+// closest returns the n contacts closest to the target
+func (t *routingTable) closest (target ID, n int) []Contact {
+	t.mu.Lock()
+	contacts := []Contact{}
+	for _, b := range t.buckets {
+		contacts = append(contacts, b.contacts...)
+	}
+	t.mu.Unlock()
+	sortByDistance(target, contacts)
+	if len(contacts) > n {
+		contacts = contacts[:n]
+	}
+	return contacts
+}
+
+func (t *routingTable) len () int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, b := range t.buckets {
+		n += len(b.contacts)
+	}
+	return n
+}
+
+func sortByDistance (target ID, contacts []Contact) {
+	sort.Slice(contacts, func (i, j int) bool {
+		return closer(target, contacts[i].ID, contacts[j].ID)
+	})
+}
+
+func indexOf (contacts []Contact, id ID) int {
+	for i, c := range contacts {
+		if c.ID == id {
+			return i
+		}
+	}
+	return -1
+}
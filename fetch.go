@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/priyangshupal/distributed-file-system/crypto"
+	"github.com/priyangshupal/distributed-file-system/p2p"
+)
+
+// fetch asks the peers for the file and writes it to the local store.
+// It reads the file from the first peer that has it, once `need` peers
+// answered. With answers from several peers, it reads from a peer that
+// holds the version most of them agree on. The streams to all the
+// other peers are closed, which stops them from sending the file.
+// fetch reports whether the file has been received.
+func (s *FileServer) fetch (ctx context.Context, key string, peers map[string]p2p.Peer, need int) (bool, error) {
+	if len(peers) == 0 {
+		return false, nil
+	}
+	req := s.newRequest(ctx, len(peers))
+	defer s.finishRequest(req)
+
+	// Open a stream to every peer and ask them to send the
+	// file over it if they have it stored
+	streams := make(map[string]p2p.Stream)
+	waiting := make(map[string]bool)
+	for id, peer := range peers {
+		st, err := peer.OpenStream()
+		if err != nil {
+			return false, err
+		}
+		defer st.Close()
+		defer closeOnDone(ctx, st)()
+
+		msg := Message {
+			RequestID: req.id,
+			Payload: MessageGetFile{
+				ID: s.ID,
+				Key: crypto.HashKey(key),
+				StreamID: st.ID(),
+			},
+		}
+		if err := s.send(peer, &msg); err != nil {
+			return false, err
+		}
+		streams[id] = st
+		waiting[id] = true
+	}
+
+	var (
+		answered int
+		// holders are the peers that have the file by digest,
+		// in the order they answered, digests in the order they
+		// were first reported
+		holders = make(map[string][]string)
+		digests []string
+		answers = make(map[string]MessageGetFileResponse)
+		tried = make(map[string]bool)
+	)
+	for {
+		if len(holders) > 0 && (answered >= need || len(waiting) == 0) {
+			for _, id := range holders[agreedDigest(digests, holders)] {
+				if tried[id] {
+					continue
+				}
+				tried[id] = true
+				ok, err := s.receive(ctx, key, id, streams[id], answers[id])
+				if err != nil || ok {
+					return ok, err
+				}
+			}
+		}
+		if len(waiting) == 0 {
+			return false, nil
+		}
+
+		resp, err := s.nextResponse(ctx, req, waiting)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, ErrServerStopped) {
+				return false, err
+			}
+			// go on with the peers that answered in time
+			log.Printf("[%s] %v\n", s.Transport.Addr(), err)
+			clear(waiting)
+			continue
+		}
+		answered++
+		if err := responseErr(resp.payload); err != nil {
+			log.Printf("[%s] peer %s failed to look up file (%s): %v\n", s.Transport.Addr(), resp.from, key, err)
+			continue
+		}
+		answer, ok := resp.payload.(MessageGetFileResponse)
+		if !ok {
+			log.Printf("[%s] peer %s answered the look up of file (%s) with %T\n", s.Transport.Addr(), resp.from, key, resp.payload)
+			continue
+		}
+		if answer.Have {
+			digest := hex.EncodeToString(answer.Digest)
+			answers[resp.from] = answer
+			if _, ok := holders[digest]; !ok {
+				digests = append(digests, digest)
+			}
+			holders[digest] = append(holders[digest], resp.from)
+		}
+	}
+}
+
+// agreedDigest returns the digest held by the most peers, the one
+// that was reported first on a tie
+func agreedDigest (digests []string, holders map[string][]string) string {
+	if len(digests) > 1 {
+		log.Printf("peers disagree on the contents of a file: %v", holders)
+	}
+	best := digests[0]
+	for _, digest := range digests[1:] {
+		if len(holders[digest]) > len(holders[best]) {
+			best = digest
+		}
+	}
+	return best
+}
+
+// receive reads the file announced in the answer of the peer from its
+// stream and checks it against the digest. It reports whether the file
+// is in the local store now.
+func (s *FileServer) receive (ctx context.Context, key string, from string, st p2p.Stream, answer MessageGetFileResponse) (bool, error) {
+	digest := sha256.New()
+	r := io.TeeReader(io.LimitReader(st, answer.Size), digest)
+	n, err := s.store.WriteDecrypt(s.EncKey, s.ID, key, r)
+	if ctx.Err() != nil {
+		s.store.Delete(s.ID, key)
+		return false, ctx.Err()
+	}
+	if err == nil && int64(n) != answer.Size {
+		err = fmt.Errorf("received (%d) of (%d) bytes", n, answer.Size)
+	}
+	if err == nil && !bytes.Equal(digest.Sum(nil), answer.Digest) {
+		err = fmt.Errorf("digest %x does not match %x", digest.Sum(nil), answer.Digest)
+	}
+	if err != nil {
+		log.Printf("[%s] discarding file (%s) from [%s]: %v\n", s.Transport.Addr(), key, from, err)
+		s.store.Delete(s.ID, key)
+		return false, nil
+	}
+	fmt.Printf("[%s] received (%d) bytes over the network from [%s]\n", s.Transport.Addr(), n, from)
+	return true, nil
+}
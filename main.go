@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"path/filepath"
 	"time"
 
 	"github.com/priyangshupal/distributed-file-system/crypto"
@@ -12,29 +13,51 @@ import (
 	"github.com/priyangshupal/distributed-file-system/store"
 )
 
-func makeServer (listenAddr string, nodes ...string) *FileServer {
+func makeServer (ca *p2p.ClusterCA, listenAddr string, nodes ...string) *FileServer {
+	storageRoot := listenAddr + "_network"
+	identityKey, err := crypto.LoadOrCreateIdentityKey(filepath.Join(storageRoot, "identity.key"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	cert, err := ca.NewNodeCertificate(listenAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
 	tcpTransportOpts := p2p.TCPTransportOpts {
 		ListenAddr: listenAddr,
-		HandshakeFunc: p2p.NOPHandshakeFunc,
-		Decoder: p2p.DefaultDecoder{},
+		PeerOpts: p2p.PeerOpts{
+			HandshakeFunc: p2p.NewHandshakeFunc(p2p.HandshakeOpts{
+				IdentityKey: identityKey,
+				ListenAddr: listenAddr,
+			}),
+			Decoder: p2p.DefaultDecoder{},
+		},
+		TLSConfig: p2p.NewMutualTLSConfig(cert, ca.CertPool()),
 	}
 	tcpTransport := p2p.NewTCPTransport(tcpTransportOpts)
 	fileServerOpts := FileServerOpts {
+		IdentityKey: identityKey,
 		EncKey: crypto.NewEncryptionKey(),
-		StorageRoot: listenAddr + "_network",
+		StorageRoot: storageRoot,
 		PathTransformFunc: store.CASPathTransformFunc,
 		Transport: tcpTransport,
 		BootstrapNodes: nodes,
 	}
 	s := NewFileServer(fileServerOpts)
 	tcpTransport.OnPeer = s.onPeer
+	tcpTransport.OnPeerDisconnect = s.onPeerDisconnect
 	return s
 }
 
 func main () {
-	s1 := makeServer(":3000", "")
-	s2 := makeServer(":4000", ":3000")
-	s3 := makeServer(":5000", ":3000", ":4000")
+	ca, err := p2p.NewClusterCA("local-cluster")
+	if err != nil {
+		log.Fatal(err)
+	}
+	s1 := makeServer(ca, ":3000", "")
+	s2 := makeServer(ca, ":4000", ":3000")
+	// s3 only knows s1 and learns about s2 through peer exchange
+	s3 := makeServer(ca, ":5000", ":3000")
 	
 	go func () {log.Fatal(s1.Start())}()
 	
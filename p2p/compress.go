@@ -0,0 +1,102 @@
+package p2p
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// chunks smaller than this are not worth compressing
+	minCompressSize = 512
+	// once this many chunks of a stream in a row did not compress,
+	// only every incompressibleProbe-th chunk is tried
+	incompressibleLimit = 4
+	incompressibleProbe = 16
+)
+
+var flateWriters = sync.Pool{
+	New: func () any {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+// CompressionStats count the stream data sent to a peer
+type CompressionStats struct {
+	CompressedFrames uint64
+	RawFrames uint64
+	// BytesIn is the size of the data written to the streams,
+	// BytesOut the size of the payloads actually sent
+	BytesIn uint64
+	BytesOut uint64
+}
+
+// Saved is the number of bytes compression saved
+func (s CompressionStats) Saved () uint64 {
+	return s.BytesIn - s.BytesOut
+}
+
+type compressionStats struct {
+	compressedFrames atomic.Uint64
+	rawFrames atomic.Uint64
+	bytesIn atomic.Uint64
+	bytesOut atomic.Uint64
+}
+
+func (c *compressionStats) add (in, out int, compressed bool) {
+	if compressed {
+		c.compressedFrames.Add(1)
+	} else {
+		c.rawFrames.Add(1)
+	}
+	c.bytesIn.Add(uint64(in))
+	c.bytesOut.Add(uint64(out))
+}
+
+func (c *compressionStats) snapshot () CompressionStats {
+	return CompressionStats{
+		CompressedFrames: c.compressedFrames.Load(),
+		RawFrames: c.rawFrames.Load(),
+		BytesIn: c.bytesIn.Load(),
+		BytesOut: c.bytesOut.Load(),
+	}
+}
+
+// compressChunk returns the compressed chunk, or false if it did not
+// shrink by at least 1/16th, as it happens for encrypted or already
+// compressed data
+func compressChunk (b []byte) ([]byte, bool) {
+	buf := bytes.NewBuffer(make([]byte, 0, len(b)))
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(buf)
+	if _, err := w.Write(b); err != nil {
+		return nil, false
+	}
+	if err := w.Close(); err != nil {
+		return nil, false
+	}
+	if buf.Len() > len(b) - len(b) / 16 {
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
+
+// decompressChunk inflates a chunk, refusing to produce more than
+// limit bytes
+func decompressChunk (b []byte, limit int) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(b))
+	defer r.Close()
+	out, err := io.ReadAll(io.LimitReader(r, int64(limit) + 1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > limit {
+		return nil, fmt.Errorf("compressed chunk inflates beyond %d bytes", limit)
+	}
+	return out, nil
+}
@@ -0,0 +1,60 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// sendOverStream writes data on a new compressed stream and returns
+// what the remote side reads
+func sendOverStream (t *testing.T, dialer, acceptor *streamMux, opened chan uint32, data []byte) []byte {
+	st, err := dialer.open()
+	assert.Nil(t, err)
+	go func () {
+		st.Write(data)
+		st.Close()
+	}()
+	remote, err := acceptor.accept(<- opened)
+	assert.Nil(t, err)
+	b, err := io.ReadAll(remote)
+	assert.Nil(t, err)
+	return b
+}
+
+func TestStreamCompression (t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	dialer, acceptor := newStreamMux(c1, true), newStreamMux(c2, false)
+	dialer.compress.Store(true)
+	opened := make(chan uint32, 2)
+	go serveMux(c1, dialer, nil)
+	go serveMux(c2, acceptor, opened)
+
+	text := bytes.Repeat([]byte("large plaintext-ish file contents\n"), 20000)
+	assert.Equal(t, text, sendOverStream(t, dialer, acceptor, opened, text))
+	stats := dialer.stats.snapshot()
+	assert.Equal(t, uint64(len(text)), stats.BytesIn)
+	assert.Zero(t, stats.RawFrames)
+	assert.Greater(t, stats.Saved(), uint64(len(text) / 2))
+
+	// random data looks like encrypted data, it is sent raw
+	random := make([]byte, 1 << 20)
+	rand.Read(random)
+	assert.Equal(t, random, sendOverStream(t, dialer, acceptor, opened, random))
+	after := dialer.stats.snapshot()
+	assert.Equal(t, stats.CompressedFrames, after.CompressedFrames)
+	assert.Equal(t, stats.Saved(), after.Saved())
+}
+
+func TestDecompressChunkLimit (t *testing.T) {
+	b, ok := compressChunk(make([]byte, maxStreamChunk * 2))
+	assert.True(t, ok)
+	_, err := decompressChunk(b, maxStreamChunk)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,260 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrTransportClosed = errors.New("transport is shut down")
+
+// PeerOpts are the options shared by the transports of this
+// package, they apply to every connection a transport establishes
+type PeerOpts struct {
+	HandshakeFunc HandshakeFunc
+	Decoder Decoder
+	OnPeer func(Peer) error
+	// OnPeerDisconnect is called once the connection of a peer
+	// accepted by OnPeer is gone
+	OnPeerDisconnect func(Peer)
+	// HeartbeatInterval is how often peers are pinged, a negative
+	// interval disables heartbeats. TCPTransport pings every 5s by
+	// default, the other transports only when it is set.
+	HeartbeatInterval time.Duration
+	// HeartbeatMisses is the number of pings in a row a peer may
+	// leave unanswered before its connection is closed, 3 by default
+	HeartbeatMisses int
+	// InboundQueueSize is the number of messages of a single peer
+	// that may wait to be consumed, 256 by default
+	InboundQueueSize int
+	// InboundOverflow decides what happens to the messages of a
+	// peer whose queue is full, see OverflowPolicy
+	InboundOverflow OverflowPolicy
+}
+
+// baseTransport is embedded by every transport of this package. It
+// owns the inbound queues and the connections, which only differ
+// between transports in how they are established.
+type baseTransport struct {
+	opts *PeerOpts
+	inbox *inbox
+	conns connTracker
+	// wrapConn is set by a FaultInjector
+	wrapConn func (net.Conn, bool) net.Conn
+}
+
+// init fills in the defaults of opts, which stay owned by the
+// embedding transport so they can still be set after construction
+func (t *baseTransport) init (opts *PeerOpts) {
+	if opts.HandshakeFunc == nil {
+		opts.HandshakeFunc = NOPHandshakeFunc
+	}
+	if opts.Decoder == nil {
+		opts.Decoder = DefaultDecoder{}
+	}
+	if opts.HeartbeatMisses == 0 {
+		opts.HeartbeatMisses = defaultHeartbeatMisses
+	}
+	t.opts = opts
+	t.inbox = newInbox(opts.InboundQueueSize, opts.InboundOverflow)
+}
+
+// InboundQueues returns the state of the inbound queue of every
+// connection
+func (t *baseTransport) InboundQueues () []InboundQueueStats {
+	return t.inbox.stats()
+}
+
+// Consume returns a read-only channel for reading incoming
+// messages from another peer in the network
+func (t *baseTransport) Consume () <- chan RPC {
+	return t.inbox.out
+}
+
+// shutdown stops accepting connections with close, then closes
+// every connection and waits for their goroutines
+func (t *baseTransport) shutdown (ctx context.Context, close func () error) error {
+	close()
+	err := t.conns.shutdown(ctx)
+	t.inbox.close()
+	return err
+}
+
+func (t *baseTransport) setConnWrapper (wrap func (net.Conn, bool) net.Conn) {
+	t.wrapConn = wrap
+}
+
+// serve serves a tracked connection of the transport listening on
+// addr until it is gone
+func (t *baseTransport) serve (conn net.Conn, outbound bool, addr string) {
+	if t.wrapConn != nil {
+		conn = t.wrapConn(conn, outbound)
+	}
+	servePeer(NewTCPPeer(conn, outbound), addr, t.opts, t.inbox)
+}
+
+// servePeer runs the handshake on a new connection, hands the peer
+// to onPeer and then reads its frames until the connection is gone.
+// It is shared by all the transports of this package, which only
+// differ in how connections are established.
+func servePeer (peer *TCPPeer, addr string, opts *PeerOpts, in *inbox) {
+	var (
+		err error
+		connected bool
+	)
+	defer func() {
+		fmt.Printf("Dropping peer connection: %s\n", err)
+		peer.mux.close(err)
+		peer.Close()
+		if connected && opts.OnPeerDisconnect != nil {
+			opts.OnPeerDisconnect(peer)
+		}
+	}()
+	if err = opts.HandshakeFunc(peer); err != nil {
+		fmt.Printf("handshake error: %s\n", err)
+		return
+	}
+	peer.mux.compress.Store(peer.Info().HasFeature(FeatureCompression))
+	if opts.OnPeer != nil {
+		if err = opts.OnPeer(peer); err != nil {
+			return
+		}
+	}
+	connected = true
+	queue := in.register(peer)
+	defer in.unregister(queue)
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	defer wg.Wait()
+	defer close(done)
+	if opts.HeartbeatInterval > 0 {
+		wg.Add(1)
+		go func () {
+			defer wg.Done()
+			if err := peer.heartbeat.run(peer.mux, opts.HeartbeatInterval, opts.HeartbeatMisses, done); err != nil {
+				fmt.Printf("[%s] closing connection with %s: %s\n", addr, peer.ID(), err)
+				peer.Close()
+			}
+		}()
+	}
+
+	// Read loop
+	for {
+		f := Frame{}
+		err = opts.Decoder.Decode(peer.conn, &f)
+		if err != nil {
+			return
+		}
+		switch f.Type {
+		case Ping:
+			// answer from another goroutine, the read loop
+			// must never block on writing
+			go peer.mux.writeFrame(Frame{Type: Pong, Payload: f.Payload})
+			continue
+		case Pong:
+			if err = peer.heartbeat.handlePong(f.Payload); err != nil {
+				return
+			}
+			continue
+		}
+		if f.Type != IncomingMessage {
+			// everything else belongs to a stream, hand it
+			// to the multiplexer without blocking the loop
+			if err = peer.mux.handleFrame(f); err != nil {
+				return
+			}
+			continue
+		}
+
+		err = in.push(queue, RPC{
+			From: peer.ID(),
+			Payload: f.Payload,
+		})
+		if err != nil {
+			return
+		}
+	}
+}
+
+// namedConn overrides the addresses of a connection, for the
+// transports whose connections don't have meaningful addresses
+type namedConn struct {
+	net.Conn
+	local net.Addr
+	remote net.Addr
+}
+
+func (c *namedConn) LocalAddr () net.Addr { return c.local }
+func (c *namedConn) RemoteAddr () net.Addr { return c.remote }
+
+// connTracker keeps track of the connections of a transport and of
+// the goroutines serving them, so the transport can shut down
+type connTracker struct {
+	mu sync.Mutex
+	conns map[net.Conn]struct{}
+	closed bool
+	wg sync.WaitGroup
+}
+
+// track registers a new connection, whose goroutine has to call
+// untrack once it is done. It returns false once the transport
+// has shut down.
+func (c *connTracker) track (conn net.Conn) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
+	if c.conns == nil {
+		c.conns = make(map[net.Conn]struct{})
+	}
+	c.conns[conn] = struct{}{}
+	c.wg.Add(1)
+	return true
+}
+
+func (c *connTracker) untrack (conn net.Conn) {
+	c.mu.Lock()
+	delete(c.conns, conn)
+	c.mu.Unlock()
+	c.wg.Done()
+}
+
+// goroutine registers any other goroutine of the transport, like
+// its accept loop. It returns false once the transport has shut down.
+func (c *connTracker) goroutine () bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
+	c.wg.Add(1)
+	return true
+}
+
+// shutdown closes every connection and waits until all the tracked
+// goroutines have exited or ctx is done
+func (c *connTracker) shutdown (ctx context.Context) error {
+	c.mu.Lock()
+	c.closed = true
+	for conn := range c.conns {
+		conn.Close()
+	}
+	c.mu.Unlock()
+
+	done := make(chan struct{})
+	go func () {
+		c.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <- done:
+		return nil
+	case <- ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,334 @@
+package p2p
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMinBackoff = time.Millisecond * 500
+	defaultMaxBackoff = time.Second * 30
+	defaultConnectTimeout = time.Second * 10
+)
+
+var ErrConnectTimeout = errors.New("connection was not established in time")
+
+type ConnState int
+
+const (
+	StateDisconnected ConnState = iota
+	StateConnecting
+	StateConnected
+	StateBackoff
+)
+
+func (s ConnState) String () string {
+	switch s {
+	case StateDisconnected:
+		return "disconnected"
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateBackoff:
+		return "backoff"
+	}
+	return "unknown"
+}
+
+// PeerStatus is the connection state of a node the ConnManager
+// keeps a connection with
+type PeerStatus struct {
+	Addr string
+	// ID is known once a connection has been established
+	ID string
+	State ConnState
+	// Attempts is the number of dials that failed in a row
+	Attempts int
+	NextAttempt time.Time
+	LastError error
+}
+
+type ConnManagerOpts struct {
+	Transport Transport
+	// MinBackoff is the delay before the first retry, it doubles
+	// after every failed attempt up to MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// ConnectTimeout is how long a successful dial may take to
+	// complete the handshake and be reported through Connected
+	ConnectTimeout time.Duration
+}
+
+// ConnManager keeps dialing the nodes it knows about until it is
+// connected to them, waiting a jittered exponential backoff between
+// attempts. The owner of the transport reports established and lost
+// connections through Connected or Accepted and Disconnected, for
+// outbound and inbound connections, so known nodes that connected to
+// us are never dialed a second time.
+type ConnManager struct {
+	ConnManagerOpts
+
+	mu sync.Mutex
+	peers map[string]*managedPeer
+	quitch chan struct{}
+	closed bool
+	wg sync.WaitGroup
+}
+
+type managedPeer struct {
+	status PeerStatus
+	removed bool
+	// wake is signalled whenever the status changes from outside
+	wake chan struct{}
+}
+
+func NewConnManager (opts ConnManagerOpts) *ConnManager {
+	if opts.MinBackoff == 0 {
+		opts.MinBackoff = defaultMinBackoff
+	}
+	if opts.MaxBackoff == 0 {
+		opts.MaxBackoff = defaultMaxBackoff
+	}
+	if opts.ConnectTimeout == 0 {
+		opts.ConnectTimeout = defaultConnectTimeout
+	}
+	return &ConnManager{
+		ConnManagerOpts: opts,
+		peers: make(map[string]*managedPeer),
+		quitch: make(chan struct{}),
+	}
+}
+
+// Add starts keeping a connection with the node listening on addr.
+// It reports whether the node was not managed before.
+func (m *ConnManager) Add (addr string) bool {
+	addr = normalizeAddr(addr)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.peers[addr]; ok || m.closed {
+		return false
+	}
+	mp := &managedPeer{
+		status: PeerStatus{Addr: addr, State: StateDisconnected},
+		wake: make(chan struct{}, 1),
+	}
+	m.peers[addr] = mp
+	m.wg.Add(1)
+	go m.run(mp)
+	return true
+}
+
+// Remove stops keeping a connection with the node listening on addr.
+// An established connection is not closed.
+func (m *ConnManager) Remove (addr string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if mp, ok := m.peers[normalizeAddr(addr)]; ok {
+		mp.removed = true
+		delete(m.peers, mp.status.Addr)
+		mp.signal()
+	}
+}
+
+// Connected reports an established connection with the node id
+// listening on addr. Unknown nodes are added to the managed set,
+// so they are redialed once the connection is lost.
+func (m *ConnManager) Connected (addr string, id string) {
+	if len(addr) == 0 {
+		return
+	}
+	m.Add(addr)
+	m.Accepted(addr, id)
+}
+
+// Accepted reports a connection that the node id listening on addr
+// established with us. Unlike Connected it doesn't add unknown nodes,
+// the node that dialed keeps the connection.
+func (m *ConnManager) Accepted (addr string, id string) {
+	if len(addr) == 0 {
+		return
+	}
+	addr = normalizeAddr(addr)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, mp := range m.peers {
+		// the same node may be known under another address
+		if mp.status.Addr != addr && (len(id) == 0 || mp.status.ID != id) {
+			continue
+		}
+		mp.status.ID = id
+		mp.status.State = StateConnected
+		mp.status.Attempts = 0
+		mp.status.LastError = nil
+		mp.signal()
+	}
+}
+
+// Disconnected reports that the connection with the node listening
+// on addr is gone. The node is redialed after a short backoff.
+func (m *ConnManager) Disconnected (addr string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mp, ok := m.peers[normalizeAddr(addr)]
+	if !ok {
+		return
+	}
+	for _, other := range m.peers {
+		if other != mp && (len(mp.status.ID) == 0 || other.status.ID != mp.status.ID) {
+			continue
+		}
+		other.status.State = StateBackoff
+		other.status.Attempts = 0
+		other.status.NextAttempt = time.Now().Add(m.backoff(0))
+		other.signal()
+	}
+}
+
+// States returns the status of every managed node, sorted by address
+func (m *ConnManager) States () []PeerStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	states := make([]PeerStatus, 0, len(m.peers))
+	for _, mp := range m.peers {
+		states = append(states, mp.status)
+	}
+	sort.Slice(states, func (i, j int) bool {
+		return states[i].Addr < states[j].Addr
+	})
+	return states
+}
+
+// Close stops all the dialing goroutines and waits for them to exit
+func (m *ConnManager) Close () {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return
+	}
+	m.closed = true
+	close(m.quitch)
+	m.mu.Unlock()
+	m.wg.Wait()
+}
+
+// run dials the node whenever it is neither connected nor backing off
+func (m *ConnManager) run (mp *managedPeer) {
+	defer m.wg.Done()
+	for {
+		if !m.waitUntilDue(mp) {
+			return
+		}
+
+		// drop a stale signal, only the outcome of this dial counts
+		select {
+		case <- mp.wake:
+		default:
+		}
+		m.mu.Lock()
+		if mp.status.State == StateConnected {
+			m.mu.Unlock()
+			continue
+		}
+		mp.status.State = StateConnecting
+		addr := mp.status.Addr
+		m.mu.Unlock()
+
+		err := m.Transport.Dial(addr)
+		if err == nil {
+			// the connection counts once the handshake is done
+			// and the owner calls Connected
+			select {
+			case <- mp.wake:
+			case <- time.After(m.ConnectTimeout):
+				err = ErrConnectTimeout
+			case <- m.quitch:
+				return
+			}
+		}
+
+		m.mu.Lock()
+		if mp.status.State == StateConnecting {
+			if err == nil {
+				err = errors.New("connection closed during handshake")
+			}
+			mp.status.State = StateBackoff
+			mp.status.LastError = err
+			mp.status.NextAttempt = time.Now().Add(m.backoff(mp.status.Attempts))
+			mp.status.Attempts++
+		}
+		m.mu.Unlock()
+	}
+}
+
+// waitUntilDue blocks while the node is connected or backing off.
+// It returns false once the node is removed or the manager closed.
+func (m *ConnManager) waitUntilDue (mp *managedPeer) bool {
+	for {
+		m.mu.Lock()
+		removed, state, next := mp.removed, mp.status.State, mp.status.NextAttempt
+		m.mu.Unlock()
+		if removed {
+			return false
+		}
+
+		var timer <- chan time.Time
+		switch state {
+		case StateConnected:
+			// wait for Disconnected
+		case StateBackoff:
+			d := time.Until(next)
+			if d <= 0 {
+				return true
+			}
+			timer = time.After(d)
+		default:
+			return true
+		}
+
+		select {
+		case <- mp.wake:
+		case <- timer:
+			return true
+		case <- m.quitch:
+			return false
+		}
+	}
+}
+
+// backoff returns the delay after the given number of failed
+// attempts, randomised between half and the full delay so that
+// nodes restarting together don't dial in lockstep
+func (m *ConnManager) backoff (attempts int) time.Duration {
+	d := m.MinBackoff
+	for i := 0; i < attempts && d < m.MaxBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, m.MaxBackoff)
+	return d / 2 + time.Duration(rand.Int63n(int64(d / 2) + 1))
+}
+
+func (mp *managedPeer) signal () {
+	select {
+	case mp.wake <- struct{}{}:
+	default:
+	}
+}
+
+// normalizeAddr makes ":3000" and "127.0.0.1:3000" the same node,
+// matching the addresses announced during the handshake
+func normalizeAddr (addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if ip := net.ParseIP(host); len(host) == 0 || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port)
+}
@@ -0,0 +1,105 @@
+package p2p
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// dialTransport is a Transport whose dials fail until up is set,
+// and then report the connection to the ConnManager
+type dialTransport struct {
+	Transport
+	mu sync.Mutex
+	up bool
+	dials int
+	mgr *ConnManager
+}
+
+func (t *dialTransport) Dial (addr string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.dials++
+	if !t.up {
+		return errors.New("connection refused")
+	}
+	go t.mgr.Connected(addr, "node-1")
+	return nil
+}
+
+func (t *dialTransport) setUp (up bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.up = up
+}
+
+func TestConnManagerReconnects (t *testing.T) {
+	tr := &dialTransport{}
+	m := NewConnManager(ConnManagerOpts{
+		Transport: tr,
+		MinBackoff: time.Millisecond * 10,
+		MaxBackoff: time.Millisecond * 40,
+	})
+	tr.mgr = m
+	defer m.Close()
+
+	m.Add(":3000")
+	assert.Eventually(t, func () bool {
+		st := m.States()[0]
+		return st.State == StateBackoff && st.Attempts >= 3
+	}, time.Second, time.Millisecond * 5)
+	assert.NotNil(t, m.States()[0].LastError)
+
+	tr.setUp(true)
+	assert.Eventually(t, func () bool {
+		return m.States()[0].State == StateConnected
+	}, time.Second, time.Millisecond * 5)
+	st := m.States()[0]
+	assert.Equal(t, "127.0.0.1:3000", st.Addr)
+	assert.Equal(t, "node-1", st.ID)
+
+	// the node comes back after a disconnect, without dialing the
+	// same node a second time under its announced address
+	m.Disconnected("127.0.0.1:3000")
+	assert.Eventually(t, func () bool {
+		return m.States()[0].State == StateConnected
+	}, time.Second, time.Millisecond * 5)
+	m.Connected("localhost:3000", "node-1")
+	assert.Len(t, m.States(), 2)
+	for _, st := range m.States() {
+		assert.Equal(t, StateConnected, st.State)
+	}
+}
+
+func TestConnManagerBackoff (t *testing.T) {
+	m := NewConnManager(ConnManagerOpts{MinBackoff: time.Second, MaxBackoff: time.Second * 8})
+	for attempts, max := range []time.Duration{1, 2, 4, 8, 8} {
+		d := m.backoff(attempts)
+		assert.GreaterOrEqual(t, d, max * time.Second / 2)
+		assert.LessOrEqual(t, d, max * time.Second)
+	}
+}
+
+func TestConnManagerAccepted (t *testing.T) {
+	tr := &dialTransport{up: true}
+	m := NewConnManager(ConnManagerOpts{Transport: tr})
+	tr.mgr = m
+	defer m.Close()
+
+	// the node that dialed us keeps the connection
+	m.Accepted(":4000", "node-2")
+	assert.Empty(t, m.States())
+
+	assert.True(t, m.Add(":3000"))
+	assert.False(t, m.Add("127.0.0.1:3000"))
+	assert.Eventually(t, func () bool {
+		return m.States()[0].State == StateConnected
+	}, time.Second, time.Millisecond * 5)
+	m.Disconnected(":3000")
+	m.Accepted(":3000", "node-1")
+	assert.Len(t, m.States(), 1)
+	assert.Equal(t, StateConnected, m.States()[0].State)
+}
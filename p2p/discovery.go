@@ -0,0 +1,225 @@
+package p2p
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultDiscoveryGroup = "239.192.77.77:7777"
+	defaultAnnounceInterval = time.Second * 2
+	maxAnnouncementSize = 1024
+)
+
+// Announcement is multicast by every node taking part in discovery
+type Announcement struct {
+	Cluster string
+	NodeID string
+	// ListenAddr is the address the node accepts connections on
+	ListenAddr string
+}
+
+type DiscoveryOpts struct {
+	// Cluster keeps separate clusters on the same network apart,
+	// announcements of other clusters are ignored
+	Cluster string
+	NodeID string
+	// ListenAddr is announced to the other nodes. A missing host,
+	// as in ":3000", is filled in by the receiver with the address
+	// the announcement came from.
+	ListenAddr string
+	// GroupAddr is the multicast group, DefaultDiscoveryGroup by default
+	GroupAddr string
+	// Interface to join the group on, the system default when nil
+	Interface *net.Interface
+	// Interval between two announcements, 2s by default
+	Interval time.Duration
+	// TTL is how long a node is remembered after its last
+	// announcement, 3 intervals by default
+	TTL time.Duration
+	// OnDiscover is called for every newly seen node. Nodes are
+	// handed to ConnManager when it is not set.
+	OnDiscover func(Announcement)
+	ConnManager *ConnManager
+}
+
+// Discovery finds the other nodes of a cluster on the local network
+// through UDP multicast. It is meant for development and lab
+// clusters, where nodes come and go without a fixed bootstrap node.
+type Discovery struct {
+	DiscoveryOpts
+
+	mu sync.Mutex
+	// nodes are the nodes heard from, by node ID
+	nodes map[string]*discoveredNode
+	conn *net.UDPConn
+	quitch chan struct{}
+	wg sync.WaitGroup
+}
+
+type discoveredNode struct {
+	Announcement
+	lastSeen time.Time
+}
+
+func NewDiscovery (opts DiscoveryOpts) *Discovery {
+	if len(opts.GroupAddr) == 0 {
+		opts.GroupAddr = DefaultDiscoveryGroup
+	}
+	if opts.Interval == 0 {
+		opts.Interval = defaultAnnounceInterval
+	}
+	if opts.TTL == 0 {
+		opts.TTL = opts.Interval * 3
+	}
+	return &Discovery{
+		DiscoveryOpts: opts,
+		nodes: make(map[string]*discoveredNode),
+		quitch: make(chan struct{}),
+	}
+}
+
+// Start joins the multicast group and starts announcing the node
+func (d *Discovery) Start () error {
+	group, err := net.ResolveUDPAddr("udp4", d.GroupAddr)
+	if err != nil {
+		return err
+	}
+	d.conn, err = net.ListenMulticastUDP("udp4", d.Interface, group)
+	if err != nil {
+		return err
+	}
+	out, err := net.DialUDP("udp4", nil, group)
+	if err != nil {
+		d.conn.Close()
+		return err
+	}
+	d.wg.Add(2)
+	go d.readLoop()
+	go d.announceLoop(out)
+	return nil
+}
+
+// Close leaves the multicast group and waits for the goroutines to exit
+func (d *Discovery) Close () error {
+	close(d.quitch)
+	err := d.conn.Close()
+	d.wg.Wait()
+	return err
+}
+
+// Nodes returns the nodes that announced themselves within TTL,
+// sorted by node ID
+func (d *Discovery) Nodes () []Announcement {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	nodes := make([]Announcement, 0, len(d.nodes))
+	for _, n := range d.nodes {
+		nodes = append(nodes, n.Announcement)
+	}
+	sort.Slice(nodes, func (i, j int) bool {
+		return nodes[i].NodeID < nodes[j].NodeID
+	})
+	return nodes
+}
+
+func (d *Discovery) readLoop () {
+	defer d.wg.Done()
+	buf := make([]byte, maxAnnouncementSize)
+	for {
+		n, from, err := d.conn.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("discovery read error: %v", err)
+			continue
+		}
+		d.handleAnnouncement(buf[:n], from, time.Now())
+	}
+}
+
+func (d *Discovery) announceLoop (out *net.UDPConn) {
+	defer d.wg.Done()
+	defer out.Close()
+	b, err := json.Marshal(Announcement{Cluster: d.Cluster, NodeID: d.NodeID, ListenAddr: d.ListenAddr})
+	if err != nil {
+		log.Printf("discovery: %v", err)
+		return
+	}
+	ticker := time.NewTicker(d.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := out.Write(b); err != nil {
+			log.Printf("discovery announce error: %v", err)
+		}
+		select {
+		case <- ticker.C:
+		case <- d.quitch:
+			return
+		}
+		d.expire(time.Now())
+	}
+}
+
+// handleAnnouncement records the node that sent the announcement and
+// reports it if it hasn't been seen within TTL or changed its address
+func (d *Discovery) handleAnnouncement (b []byte, from net.Addr, now time.Time) {
+	var a Announcement
+	if err := json.Unmarshal(b, &a); err != nil {
+		return
+	}
+	if a.Cluster != d.Cluster || a.NodeID == d.NodeID || len(a.NodeID) == 0 || len(a.ListenAddr) == 0 {
+		return
+	}
+	a.ListenAddr = advertisedAddr(a.ListenAddr, from)
+
+	d.mu.Lock()
+	n, ok := d.nodes[a.NodeID]
+	if ok && n.ListenAddr == a.ListenAddr {
+		n.lastSeen = now
+		d.mu.Unlock()
+		return
+	}
+	d.nodes[a.NodeID] = &discoveredNode{Announcement: a, lastSeen: now}
+	d.mu.Unlock()
+
+	log.Printf("discovered node %s listening on %s", a.NodeID, a.ListenAddr)
+	if d.OnDiscover != nil {
+		d.OnDiscover(a)
+		return
+	}
+	if d.ConnManager != nil {
+		// the node moved, its old address is not dialed anymore
+		if ok {
+			d.ConnManager.Remove(n.ListenAddr)
+		}
+		d.ConnManager.Add(a.ListenAddr)
+	}
+}
+
+// expire forgets the nodes that stopped announcing themselves, the
+// connection manager stops redialing them
+func (d *Discovery) expire (now time.Time) {
+	d.mu.Lock()
+	expired := []string{}
+	for id, n := range d.nodes {
+		if now.Sub(n.lastSeen) > d.TTL {
+			delete(d.nodes, id)
+			expired = append(expired, n.ListenAddr)
+		}
+	}
+	d.mu.Unlock()
+
+	if d.OnDiscover != nil || d.ConnManager == nil {
+		return
+	}
+	for _, addr := range expired {
+		d.ConnManager.Remove(addr)
+	}
+}
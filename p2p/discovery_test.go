@@ -0,0 +1,71 @@
+package p2p
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func announcement (t *testing.T, a Announcement) []byte {
+	b, err := json.Marshal(a)
+	assert.Nil(t, err)
+	return b
+}
+
+func TestDiscoveryAnnouncements (t *testing.T) {
+	seen := []Announcement{}
+	d := NewDiscovery(DiscoveryOpts{
+		Cluster: "lab",
+		NodeID: "self",
+		ListenAddr: ":3000",
+		TTL: time.Second,
+		OnDiscover: func (a Announcement) { seen = append(seen, a) },
+	})
+	from := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 7777}
+	now := time.Now()
+
+	d.handleAnnouncement(announcement(t, Announcement{Cluster: "lab", NodeID: "a", ListenAddr: ":4000"}), from, now)
+	// duplicates, our own announcement, other clusters and garbage
+	d.handleAnnouncement(announcement(t, Announcement{Cluster: "lab", NodeID: "a", ListenAddr: ":4000"}), from, now)
+	d.handleAnnouncement(announcement(t, Announcement{Cluster: "lab", NodeID: "self", ListenAddr: ":3000"}), from, now)
+	d.handleAnnouncement(announcement(t, Announcement{Cluster: "prod", NodeID: "b", ListenAddr: ":5000"}), from, now)
+	d.handleAnnouncement([]byte("not json"), from, now)
+
+	assert.Equal(t, []Announcement{{Cluster: "lab", NodeID: "a", ListenAddr: "10.0.0.2:4000"}}, seen)
+	assert.Len(t, d.Nodes(), 1)
+
+	// a node that stopped announcing expires and is reported
+	// again once it comes back
+	d.expire(now.Add(time.Second * 2))
+	assert.Empty(t, d.Nodes())
+	d.handleAnnouncement(announcement(t, Announcement{Cluster: "lab", NodeID: "a", ListenAddr: ":4000"}), from, now.Add(time.Second * 3))
+	assert.Len(t, seen, 2)
+}
+
+func TestDiscoveryFeedsConnManager (t *testing.T) {
+	tr := &dialTransport{up: true}
+	m := NewConnManager(ConnManagerOpts{Transport: tr})
+	tr.mgr = m
+	defer m.Close()
+	d := NewDiscovery(DiscoveryOpts{Cluster: "lab", NodeID: "self", ConnManager: m})
+	from := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 7777}
+
+	d.handleAnnouncement(announcement(t, Announcement{Cluster: "lab", NodeID: "a", ListenAddr: ":4000"}), from, time.Now())
+	assert.Eventually(t, func () bool {
+		states := m.States()
+		return len(states) == 1 && states[0].Addr == "10.0.0.2:4000" && states[0].State == StateConnected
+	}, time.Second, time.Millisecond * 10)
+
+	// a node that moved is dialed on its new address only
+	d.handleAnnouncement(announcement(t, Announcement{Cluster: "lab", NodeID: "a", ListenAddr: ":4001"}), from, time.Now())
+	states := m.States()
+	assert.Len(t, states, 1)
+	assert.Equal(t, "10.0.0.2:4001", states[0].Addr)
+
+	// a node that stopped announcing is no longer dialed
+	d.expire(time.Now().Add(d.TTL * 2))
+	assert.Empty(t, m.States())
+}
@@ -6,34 +6,18 @@ import (
 )
 
 type Decoder interface {
-	Decode (io.Reader, *RPC) error
+	Decode (io.Reader, *Frame) error
 }
 
 type GOBDecoder struct {}
 type DefaultDecoder struct {}
 
-func (dec GOBDecoder) Decode(r io.Reader, msg *RPC) error {
-	return gob.NewDecoder(r).Decode(msg)
+func (dec GOBDecoder) Decode(r io.Reader, f *Frame) error {
+	return gob.NewDecoder(r).Decode(f)
 }
 
-func (dec DefaultDecoder) Decode(r io.Reader, msg *RPC) error {
-	peekBuf := make ([]byte, 1)
-	if _, err := r.Read(peekBuf); err != nil {
-		return nil
-	}
-
-	// in case of a stream, we are not decoding received over the
-	// network. We are just setting stream -> true
-	stream := peekBuf[0] == IncomingStream
-	if stream {
-		msg.Stream = true
-		return nil
-	}
-	buf := make ([]byte, 1024)
-	n, err := r.Read(buf)
-	if (err != nil) {
-		return err
-	}
-	msg.Payload = buf[:n]
-	return nil
-}
\ No newline at end of file
+// DefaultDecoder reads one length-prefixed frame from the
+// connection (see ReadFrame)
+func (dec DefaultDecoder) Decode(r io.Reader, f *Frame) error {
+	return ReadFrame(r, f)
+}
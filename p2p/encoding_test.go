@@ -0,0 +1,44 @@
+package p2p
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultDecoderFrames (t *testing.T) {
+	large := bytes.Repeat([]byte("a"), 4096)
+	buf := new(bytes.Buffer)
+
+	// two messages and a stream frame coalesced into a single read
+	assert.Nil(t, WriteFrame(buf, Frame{Type: IncomingMessage, Payload: large}))
+	assert.Nil(t, WriteFrame(buf, Frame{Type: IncomingMessage, Payload: []byte("small")}))
+	assert.Nil(t, WriteFrame(buf, Frame{Type: StreamOpen, StreamID: 7}))
+
+	dec := DefaultDecoder{}
+
+	f := Frame{}
+	assert.Nil(t, dec.Decode(buf, &f))
+	assert.Equal(t, large, f.Payload)
+
+	f = Frame{}
+	assert.Nil(t, dec.Decode(buf, &f))
+	assert.Equal(t, []byte("small"), f.Payload)
+
+	f = Frame{}
+	assert.Nil(t, dec.Decode(buf, &f))
+	assert.Equal(t, byte(StreamOpen), f.Type)
+	assert.Equal(t, uint32(7), f.StreamID)
+
+	assert.NotNil(t, dec.Decode(buf, &f))
+}
+
+func TestReadFrameTruncated (t *testing.T) {
+	buf := new(bytes.Buffer)
+	assert.Nil(t, WriteFrame(buf, Frame{Type: IncomingMessage, Payload: []byte("hello world")}))
+	truncated := bytes.NewReader(buf.Bytes()[:buf.Len() - 3])
+
+	var f Frame
+	assert.NotNil(t, ReadFrame(truncated, &f))
+}
@@ -0,0 +1,300 @@
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrPartitioned = errors.New("node is partitioned")
+
+// faultQueueSize is the number of frames a connection buffers
+// while they are delayed, writes block once it is full
+const faultQueueSize = 1024
+
+// Faults are the network conditions simulated by a FaultInjector
+type Faults struct {
+	// Latency is added to every frame, plus a random delay of up
+	// to Jitter. Frames of a connection are never reordered.
+	Latency time.Duration
+	Jitter time.Duration
+	// DropRate and DuplicateRate are the probabilities, between 0
+	// and 1, that a message, ping or pong frame is dropped or sent
+	// twice. Streams have no retransmission, so their frames are
+	// never dropped or duplicated.
+	DropRate float64
+	DuplicateRate float64
+	// Bandwidth limits every connection to the given number of
+	// bytes per second, 0 means unlimited
+	Bandwidth int
+}
+
+// connWrapper is implemented by the transports of this package,
+// so faults can be injected on the frames of their connections
+type connWrapper interface {
+	setConnWrapper(func (conn net.Conn, outbound bool) net.Conn)
+}
+
+// FaultInjector simulates a bad network between the transports it
+// wraps. Faults can be changed at any time, also while frames are in
+// flight. All random decisions are drawn from a single source seeded
+// with the seed, so a run is reproducible as long as the frames are
+// sent in the same order.
+//
+// Faults apply to the frames a node writes, so both ends of a
+// connection must be wrapped to affect both directions.
+type FaultInjector struct {
+	mu sync.Mutex
+	rng *rand.Rand
+	faults Faults
+	// group of every node of the current partition
+	groups map[string]int
+	// endpoints maps the local address of outbound connections to
+	// the node that dialed them, so the accepting side knows which
+	// node is at the other end
+	endpoints map[string]string
+}
+
+func NewFaultInjector (seed int64) *FaultInjector {
+	return &FaultInjector{
+		rng: rand.New(rand.NewSource(seed)),
+		groups: make(map[string]int),
+		endpoints: make(map[string]string),
+	}
+}
+
+// SetFaults replaces the simulated network conditions
+func (fi *FaultInjector) SetFaults (f Faults) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	fi.faults = f
+}
+
+// Partition splits the given nodes, by transport address, into groups
+// that can't reach each other. Messages between nodes of different
+// groups are dropped and dials fail with ErrPartitioned. Frames of
+// streams that are already open still get through, as if the partition
+// started once they are done. Nodes that
+// are not part of any group can still reach every node.
+func (fi *FaultInjector) Partition (groups ...[]string) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	fi.groups = make(map[string]int)
+	for i, group := range groups {
+		for _, addr := range group {
+			fi.groups[normalizeAddr(addr)] = i
+		}
+	}
+}
+
+// Heal removes the partition
+func (fi *FaultInjector) Heal () {
+	fi.Partition()
+}
+
+// Wrap returns a transport that injects the faults on every connection
+// of t. Frames can only be delayed, dropped or duplicated for the
+// transports of this package, for other transports only dials are
+// affected by partitions.
+func (fi *FaultInjector) Wrap (t Transport) *FaultTransport {
+	ft := &FaultTransport{Transport: t, injector: fi}
+	if w, ok := t.(connWrapper); ok {
+		w.setConnWrapper(ft.wrapConn)
+	}
+	return ft
+}
+
+func (fi *FaultInjector) partitioned (a, b string) bool {
+	ga, ok := fi.groups[normalizeAddr(a)]
+	if !ok {
+		return false
+	}
+	gb, ok := fi.groups[normalizeAddr(b)]
+	return ok && ga != gb
+}
+
+// decide draws the fate of a frame sent from local to remote. Only
+// control frames are dropped or duplicated, streams have no
+// retransmission and would wait forever for a lost frame.
+func (fi *FaultInjector) decide (local, remote string, control bool) (drop bool, copies int, delay time.Duration) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	if control && len(remote) > 0 && fi.partitioned(local, remote) {
+		return true, 0, 0
+	}
+	f := fi.faults
+	if control && f.DropRate > 0 && fi.rng.Float64() < f.DropRate {
+		return true, 0, 0
+	}
+	copies = 1
+	if control && f.DuplicateRate > 0 && fi.rng.Float64() < f.DuplicateRate {
+		copies = 2
+	}
+	delay = f.Latency
+	if f.Jitter > 0 {
+		delay += time.Duration(fi.rng.Int63n(int64(f.Jitter)))
+	}
+	return false, copies, delay
+}
+
+func (fi *FaultInjector) bandwidth () int {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	return fi.faults.Bandwidth
+}
+
+// FaultTransport is a transport wrapped by a FaultInjector
+type FaultTransport struct {
+	Transport
+	injector *FaultInjector
+}
+
+// Dial fails while the node at addr is partitioned from this one
+func (t *FaultTransport) Dial (addr string) error {
+	t.injector.mu.Lock()
+	partitioned := t.injector.partitioned(t.Addr(), addr)
+	t.injector.mu.Unlock()
+	if partitioned {
+		return fmt.Errorf("%w: can't reach %s from %s", ErrPartitioned, addr, t.Addr())
+	}
+	return t.Transport.Dial(addr)
+}
+
+func (t *FaultTransport) wrapConn (conn net.Conn, outbound bool) net.Conn {
+	fc := &faultConn{
+		Conn: conn,
+		injector: t.injector,
+		local: t.Addr(),
+		queue: make(chan delayedFrame, faultQueueSize),
+		closed: make(chan struct{}),
+	}
+	t.injector.mu.Lock()
+	if outbound {
+		fc.remote = conn.RemoteAddr().String()
+		t.injector.endpoints[conn.LocalAddr().String()] = fc.local
+	}
+	t.injector.mu.Unlock()
+	go fc.writeLoop()
+	return fc
+}
+
+type delayedFrame struct {
+	b []byte
+	at time.Time
+}
+
+// faultConn delays, drops and duplicates the frames written to it.
+// Every Write carries exactly one frame, see WriteFrame.
+type faultConn struct {
+	net.Conn
+	injector *FaultInjector
+	// local and remote are the addresses of the nodes at both ends,
+	// remote is looked up lazily for accepted connections
+	local string
+	remote string
+
+	mu sync.Mutex
+	// last is when the previous frame is delivered
+	last time.Time
+	err error
+
+	queue chan delayedFrame
+	closed chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *faultConn) remoteNode () string {
+	if len(c.remote) == 0 {
+		c.injector.mu.Lock()
+		c.remote = c.injector.endpoints[c.Conn.RemoteAddr().String()]
+		c.injector.mu.Unlock()
+	}
+	return c.remote
+}
+
+func (c *faultConn) Write (b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return 0, c.err
+	}
+	select {
+	case <- c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	drop, copies, delay := c.injector.decide(c.local, c.remoteNode(), isControlFrame(b))
+	if drop {
+		return len(b), nil
+	}
+	at := time.Now().Add(delay)
+	if at.Before(c.last) {
+		at = c.last
+	}
+	c.last = at
+	frame := delayedFrame{b: bytes.Clone(b), at: at}
+	for i := 0; i < copies; i++ {
+		select {
+		case c.queue <- frame:
+		case <- c.closed:
+			return 0, net.ErrClosed
+		}
+	}
+	return len(b), nil
+}
+
+// isControlFrame tells whether the encoded frame b is a message, ping
+// or pong, whose loss the nodes recover from with their timeouts
+func isControlFrame (b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+	switch b[0] {
+	case IncomingMessage, Ping, Pong:
+		return true
+	}
+	return false
+}
+
+// writeLoop delivers the frames once they are due
+func (c *faultConn) writeLoop () {
+	for {
+		var f delayedFrame
+		select {
+		case f = <- c.queue:
+		case <- c.closed:
+			return
+		}
+		if d := time.Until(f.at); d > 0 {
+			select {
+			case <- time.After(d):
+			case <- c.closed:
+				return
+			}
+		}
+		if _, err := c.Conn.Write(f.b); err != nil {
+			c.mu.Lock()
+			c.err = err
+			c.mu.Unlock()
+			c.Close()
+			return
+		}
+		if bw := c.injector.bandwidth(); bw > 0 {
+			time.Sleep(time.Duration(len(f.b)) * time.Second / time.Duration(bw))
+		}
+	}
+}
+
+func (c *faultConn) Close () error {
+	c.closeOnce.Do(func () {
+		close(c.closed)
+		c.injector.mu.Lock()
+		delete(c.injector.endpoints, c.Conn.LocalAddr().String())
+		c.injector.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
@@ -0,0 +1,137 @@
+package p2p
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newFaultyPair connects two MemTransports wrapped by the injector
+// and returns the peer of node2 on node1's side and vice versa
+func newFaultyPair (t *testing.T, fi *FaultInjector) (*FaultTransport, *FaultTransport, Peer, Peer) {
+	network := NewMemNetwork()
+	peers := make(chan Peer, 2)
+	onPeer := func (p Peer) error { peers <- p; return nil }
+	tr1 := fi.Wrap(NewMemTransport(MemTransportOpts{Network: network, ListenAddr: "node1", PeerOpts: PeerOpts{OnPeer: onPeer}}))
+	tr2 := fi.Wrap(NewMemTransport(MemTransportOpts{Network: network, ListenAddr: "node2", PeerOpts: PeerOpts{OnPeer: onPeer}}))
+	assert.Nil(t, tr1.ListenAndAccept())
+	assert.Nil(t, tr2.ListenAndAccept())
+	assert.Nil(t, tr1.Dial("node2"))
+	p1, p2 := <- peers, <- peers
+	if !p1.Outbound() {
+		p1, p2 = p2, p1
+	}
+	t.Cleanup(func () { p1.Close() })
+	return tr1, tr2, p1, p2
+}
+
+func receive (tr Transport, timeout time.Duration) (RPC, bool) {
+	select {
+	case rpc := <- tr.Consume():
+		return rpc, true
+	case <- time.After(timeout):
+		return RPC{}, false
+	}
+}
+
+func TestFaultInjectorPartition (t *testing.T) {
+	fi := NewFaultInjector(1)
+	tr1, tr2, p, _ := newFaultyPair(t, fi)
+
+	fi.Partition([]string{"node1"}, []string{"node2"})
+	assert.ErrorIs(t, tr1.Dial("node2"), ErrPartitioned)
+	assert.Nil(t, p.Send([]byte("lost")))
+	_, ok := receive(tr2, time.Millisecond * 50)
+	assert.False(t, ok)
+
+	fi.Heal()
+	assert.Nil(t, p.Send([]byte("delivered")))
+	rpc, ok := receive(tr2, time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("delivered"), rpc.Payload)
+}
+
+func TestFaultInjectorDropDuplicateLatency (t *testing.T) {
+	fi := NewFaultInjector(1)
+	_, tr2, p, _ := newFaultyPair(t, fi)
+
+	fi.SetFaults(Faults{DropRate: 1})
+	assert.Nil(t, p.Send([]byte("dropped")))
+	_, ok := receive(tr2, time.Millisecond * 50)
+	assert.False(t, ok)
+
+	fi.SetFaults(Faults{DuplicateRate: 1})
+	assert.Nil(t, p.Send([]byte("twice")))
+	for i := 0; i < 2; i++ {
+		rpc, ok := receive(tr2, time.Second)
+		assert.True(t, ok)
+		assert.Equal(t, []byte("twice"), rpc.Payload)
+	}
+
+	fi.SetFaults(Faults{Latency: time.Millisecond * 100})
+	start := time.Now()
+	assert.Nil(t, p.Send([]byte("late")))
+	_, ok = receive(tr2, time.Second)
+	assert.True(t, ok)
+	assert.GreaterOrEqual(t, time.Since(start), time.Millisecond * 100)
+}
+
+func TestFaultInjectorSeed (t *testing.T) {
+	faults := Faults{DropRate: 0.3, DuplicateRate: 0.3, Jitter: time.Second}
+	fi1, fi2 := NewFaultInjector(42), NewFaultInjector(42)
+	fi1.SetFaults(faults)
+	fi2.SetFaults(faults)
+	for i := 0; i < 100; i++ {
+		drop1, copies1, delay1 := fi1.decide("a", "b", true)
+		drop2, copies2, delay2 := fi2.decide("a", "b", true)
+		assert.Equal(t, drop1, drop2)
+		assert.Equal(t, copies1, copies2)
+		assert.Equal(t, delay1, delay2)
+	}
+}
+
+// acceptStream waits for the stream opened by the other end
+func acceptStream (t *testing.T, p Peer, id uint32) Stream {
+	var st Stream
+	assert.Eventually(t, func () bool {
+		var err error
+		st, err = p.AcceptStream(id)
+		return err == nil
+	}, time.Second, time.Millisecond * 5)
+	return st
+}
+
+func TestFaultInjectorStreams (t *testing.T) {
+	fi := NewFaultInjector(1)
+	_, _, p1, p2 := newFaultyPair(t, fi)
+
+	// stream frames are neither dropped nor duplicated
+	fi.SetFaults(Faults{DropRate: 1, DuplicateRate: 1})
+	payload := bytes.Repeat([]byte("x"), streamWindowSize * 3)
+	st, err := p1.OpenStream()
+	assert.Nil(t, err)
+	go func () {
+		st.Write(payload)
+		st.Close()
+	}()
+	b, err := io.ReadAll(acceptStream(t, p2, st.ID()))
+	assert.Nil(t, err)
+	assert.Equal(t, payload, b)
+
+	// nor held back by a partition once the stream is open
+	fi.SetFaults(Faults{})
+	st, err = p1.OpenStream()
+	assert.Nil(t, err)
+	remote := acceptStream(t, p2, st.ID())
+	fi.Partition([]string{"node1"}, []string{"node2"})
+	go func () {
+		st.Write(payload)
+		st.Close()
+	}()
+	b, err = io.ReadAll(remote)
+	assert.Nil(t, err)
+	assert.Equal(t, payload, b)
+}
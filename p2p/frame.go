@@ -0,0 +1,91 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Every frame on the wire starts with a fixed size header
+//
+//	| type (1 byte) | flags (1 byte) | stream id (4 bytes) | length (4 bytes) |
+//
+// followed by exactly `length` bytes of payload. Multi-byte fields
+// are big endian. Control messages always travel on stream 0.
+const frameHeaderSize = 10
+
+// MaxFrameSize is the largest payload a single frame is allowed
+// to carry. Anything larger is treated as a corrupted connection.
+const MaxFrameSize = 16 << 20
+
+var ErrFrameTooLarge = errors.New("frame exceeds maximum frame size")
+
+// Frame flags
+const (
+	// FlagCompressed marks a StreamData payload compressed with flate
+	FlagCompressed byte = 1 << 0
+)
+
+type Frame struct {
+	Type byte
+	Flags byte
+	StreamID uint32
+	Payload []byte
+}
+
+// WriteFrame writes the header and the payload of the frame
+// in a single Write call, so concurrent writers that are
+// serialised by the caller never split a frame.
+func WriteFrame (w io.Writer, f Frame) error {
+	buf, err := encodeFrame(f)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
+
+// encodeFrame returns the frame as it is sent on the wire. The
+// payload is copied, so the caller may reuse it right away.
+func encodeFrame (f Frame) ([]byte, error) {
+	if len(f.Payload) > MaxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+	buf := make([]byte, frameHeaderSize + len(f.Payload))
+	buf[0] = f.Type
+	buf[1] = f.Flags
+	binary.BigEndian.PutUint32(buf[2:6], f.StreamID)
+	binary.BigEndian.PutUint32(buf[6:frameHeaderSize], uint32(len(f.Payload)))
+	copy(buf[frameHeaderSize:], f.Payload)
+	return buf, nil
+}
+
+// ReadFrame reads exactly one frame from r. It blocks until the
+// whole payload announced in the header has been received.
+func ReadFrame (r io.Reader, f *Frame) error {
+	return readFrame(r, f, MaxFrameSize)
+}
+
+// readFrame is ReadFrame for frames of at most limit bytes
+func readFrame (r io.Reader, f *Frame, limit uint32) error {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return err
+	}
+	length := binary.BigEndian.Uint32(header[6:frameHeaderSize])
+	if length > limit {
+		return fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, length)
+	}
+	f.Type = header[0]
+	f.Flags = header[1]
+	f.StreamID = binary.BigEndian.Uint32(header[2:6])
+	f.Payload = make([]byte, length)
+	if _, err := io.ReadFull(r, f.Payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
+}
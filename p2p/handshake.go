@@ -1,5 +1,342 @@
 package p2p
 
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/priyangshupal/distributed-file-system/crypto"
+)
+
 type HandshakeFunc func (Peer) error
 
-func NOPHandshakeFunc(Peer) error {return nil}
\ No newline at end of file
+func NOPHandshakeFunc(Peer) error {return nil}
+
+const (
+	// ProtocolVersion is the version of the wire protocol spoken by
+	// this package, MinProtocolVersion the oldest one it still speaks
+	ProtocolVersion uint16 = 1
+	MinProtocolVersion uint16 = 1
+)
+
+// Features a node can announce during the handshake
+const (
+	FeatureStreamMux = "stream-mux"
+	// FeatureCompression compresses the data of streams with flate
+	FeatureCompression = "flate"
+)
+
+// DefaultFeatures are the features announced when HandshakeOpts
+// does not list any
+var DefaultFeatures = []string{FeatureStreamMux, FeatureCompression}
+
+const (
+	challengeSize = 32
+	defaultHandshakeTimeout = time.Second * 5
+	// maxHandshakeFrameSize is far more than any handshake message
+	// needs, a node that is not authenticated yet can't make us
+	// allocate more
+	maxHandshakeFrameSize = 4 << 10
+)
+
+// handshakeContext is prepended to every signed challenge, so the
+// signatures can't be reused anywhere else
+var handshakeContext = []byte("cas-distributed-file-system handshake v1")
+
+var (
+	ErrHandshakeFailed = errors.New("handshake failed")
+	ErrIncompatibleVersion = errors.New("incompatible protocol version")
+)
+
+// Hello is what a node tells about itself during the handshake
+type Hello struct {
+	NodeID string
+	// ListenAddr is the address the node accepts connections on
+	ListenAddr string
+	Version uint16
+	MinVersion uint16
+	Features []string
+}
+
+// PeerInfo is what has been agreed on with the remote node
+// during the handshake
+type PeerInfo struct {
+	// ListenAddr is the address the remote node can be dialed on,
+	// also for peers that connected to us
+	ListenAddr string
+	// Version is the protocol version spoken with the remote node
+	Version uint16
+	// Features are the features supported by both nodes
+	Features []string
+}
+
+func (i PeerInfo) HasFeature (feature string) bool {
+	return slices.Contains(i.Features, feature)
+}
+
+// handshakePeer is implemented by the peers of the transports of
+// this package, so the handshake can run on the connection before
+// its writer takes over and record what it has verified
+type handshakePeer interface {
+	Peer
+	rawConn() net.Conn
+	setID(string)
+	setInfo(PeerInfo)
+}
+
+type HandshakeOpts struct {
+	// IdentityKey is the long-lived key of the local node
+	IdentityKey ed25519.PrivateKey
+	// ListenAddr is announced to the remote node
+	ListenAddr string
+	// Features are announced to the remote node, DefaultFeatures
+	// when empty
+	Features []string
+	// Timeout bounds the whole handshake, 5s by default
+	Timeout time.Duration
+}
+
+// handshakeMessage is the JSON payload of every Handshake frame.
+// Hello is kept as raw bytes, because it is covered by the signature.
+type handshakeMessage struct {
+	PublicKey []byte `json:",omitempty"`
+	Challenge []byte `json:",omitempty"`
+	Signature []byte `json:",omitempty"`
+	Hello []byte `json:",omitempty"`
+}
+
+// NewHandshakeFunc returns a handshake in which both nodes prove that
+// they hold the private key of the identity they claim and exchange
+// a signed Hello. The dialing node (D) and the accepting node (A) send
+//
+//	D -> A: public key D, challenge D, hello D
+//	A -> D: public key A, challenge A, hello A, signature A(challenge D, hello A)
+//	D -> A: signature D(challenge A, hello D)
+//
+// The ID derived from the verified public key and the negotiated
+// PeerInfo are stored on the peer. Nodes without a common protocol
+// version are rejected with ErrIncompatibleVersion.
+func NewHandshakeFunc (opts HandshakeOpts) HandshakeFunc {
+	if opts.Timeout == 0 {
+		opts.Timeout = defaultHandshakeTimeout
+	}
+	if len(opts.Features) == 0 {
+		opts.Features = DefaultFeatures
+	}
+	return func (p Peer) error {
+		hp, ok := p.(handshakePeer)
+		if !ok {
+			return fmt.Errorf("%w: unsupported peer type %T", ErrHandshakeFailed, p)
+		}
+		conn := hp.rawConn()
+		conn.SetDeadline(time.Now().Add(opts.Timeout))
+		defer conn.SetDeadline(time.Time{})
+
+		pub := opts.IdentityKey.Public().(ed25519.PublicKey)
+		hello, err := json.Marshal(Hello{
+			NodeID: crypto.IDFromPublicKey(pub),
+			ListenAddr: opts.ListenAddr,
+			Version: ProtocolVersion,
+			MinVersion: MinProtocolVersion,
+			Features: opts.Features,
+		})
+		if err != nil {
+			return err
+		}
+
+		var remote *handshakeMessage
+		if hp.Outbound() {
+			remote, err = dialHandshake(conn, opts.IdentityKey, hello)
+		} else {
+			remote, err = acceptHandshake(conn, opts.IdentityKey, hello)
+		}
+		if err != nil {
+			if errors.Is(err, ErrIncompatibleVersion) {
+				return err
+			}
+			return fmt.Errorf("%w: %v", ErrHandshakeFailed, err)
+		}
+
+		// remote has been verified at this point
+		var remoteHello Hello
+		json.Unmarshal(remote.Hello, &remoteHello)
+		hp.setID(remoteHello.NodeID)
+		hp.setInfo(PeerInfo{
+			ListenAddr: advertisedAddr(remoteHello.ListenAddr, p.RemoteAddr()),
+			Version: min(ProtocolVersion, remoteHello.Version),
+			Features: commonFeatures(opts.Features, remoteHello.Features),
+		})
+		return nil
+	}
+}
+
+func dialHandshake (conn io.ReadWriter, key ed25519.PrivateKey, hello []byte) (*handshakeMessage, error) {
+	pub := key.Public().(ed25519.PublicKey)
+	challenge, err := newChallenge()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeHandshake(conn, &handshakeMessage{PublicKey: pub, Challenge: challenge, Hello: hello}); err != nil {
+		return nil, err
+	}
+
+	remote, err := readHandshake(conn)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyRemote(remote, pub, challenge); err != nil {
+		return nil, err
+	}
+	if err := checkHello(remote.Hello); err != nil {
+		return nil, err
+	}
+
+	sig := ed25519.Sign(key, signedChallenge(remote.Challenge, pub, hello))
+	return remote, writeHandshake(conn, &handshakeMessage{Signature: sig})
+}
+
+func acceptHandshake (conn io.ReadWriter, key ed25519.PrivateKey, hello []byte) (*handshakeMessage, error) {
+	pub := key.Public().(ed25519.PublicKey)
+	remote, err := readHandshake(conn)
+	if err != nil {
+		return nil, err
+	}
+	if len(remote.PublicKey) != ed25519.PublicKeySize || len(remote.Challenge) != challengeSize {
+		return nil, errors.New("malformed handshake from dialing node")
+	}
+
+	challenge, err := newChallenge()
+	if err != nil {
+		return nil, err
+	}
+	sig := ed25519.Sign(key, signedChallenge(remote.Challenge, pub, hello))
+	msg := &handshakeMessage{PublicKey: pub, Challenge: challenge, Hello: hello, Signature: sig}
+	if err := writeHandshake(conn, msg); err != nil {
+		return nil, err
+	}
+	// the dialing node has our hello now and reports the
+	// incompatibility on its side as well
+	if err := checkHello(remote.Hello); err != nil {
+		return nil, err
+	}
+
+	answer, err := readHandshake(conn)
+	if err != nil {
+		return nil, err
+	}
+	remote.Signature = answer.Signature
+	if err := verifyRemote(remote, pub, challenge); err != nil {
+		return nil, err
+	}
+	return remote, nil
+}
+
+// verifyRemote checks that the remote node signed our challenge
+// and its hello with the key it claims, and that its hello
+// announces the ID of that key
+func verifyRemote (remote *handshakeMessage, local ed25519.PublicKey, challenge []byte) error {
+	if len(remote.PublicKey) != ed25519.PublicKeySize {
+		return errors.New("malformed public key from remote node")
+	}
+	key := ed25519.PublicKey(remote.PublicKey)
+	if !ed25519.Verify(key, signedChallenge(challenge, key, remote.Hello), remote.Signature) {
+		return errors.New("invalid signature from remote node")
+	}
+	if key.Equal(local) {
+		return errors.New("connected to itself")
+	}
+	var hello Hello
+	if err := json.Unmarshal(remote.Hello, &hello); err != nil {
+		return fmt.Errorf("malformed hello from remote node: %v", err)
+	}
+	if hello.NodeID != crypto.IDFromPublicKey(key) {
+		return fmt.Errorf("remote node announced ID %s that does not match its key", hello.NodeID)
+	}
+	return nil
+}
+
+// checkHello makes sure that both nodes speak a common protocol version
+func checkHello (b []byte) error {
+	var hello Hello
+	if err := json.Unmarshal(b, &hello); err != nil {
+		return fmt.Errorf("malformed hello from remote node: %v", err)
+	}
+	if min(ProtocolVersion, hello.Version) < max(MinProtocolVersion, hello.MinVersion) {
+		return fmt.Errorf("%w: local node speaks versions %d-%d, remote node %s (%s) speaks %d-%d",
+			ErrIncompatibleVersion, MinProtocolVersion, ProtocolVersion, hello.NodeID, hello.ListenAddr, hello.MinVersion, hello.Version)
+	}
+	return nil
+}
+
+// advertisedAddr fills in the host of a listen address like ":3000"
+// with the address the remote node connected or sent from
+func advertisedAddr (listenAddr string, remote net.Addr) string {
+	host, port, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return listenAddr
+	}
+	if ip := net.ParseIP(host); len(host) > 0 && (ip == nil || !ip.IsUnspecified()) {
+		return listenAddr
+	}
+	var remoteIP net.IP
+	switch addr := remote.(type) {
+	case *net.TCPAddr:
+		remoteIP = addr.IP
+	case *net.UDPAddr:
+		remoteIP = addr.IP
+	default:
+		return listenAddr
+	}
+	return net.JoinHostPort(remoteIP.String(), port)
+}
+
+func commonFeatures (local, remote []string) []string {
+	features := []string{}
+	for _, f := range local {
+		if slices.Contains(remote, f) {
+			features = append(features, f)
+		}
+	}
+	return features
+}
+
+// signedChallenge is the data a node signs to answer a challenge
+func signedChallenge (challenge []byte, signer ed25519.PublicKey, hello []byte) []byte {
+	return bytes.Join([][]byte{handshakeContext, challenge, signer, hello}, nil)
+}
+
+func newChallenge () ([]byte, error) {
+	challenge := make([]byte, challengeSize)
+	_, err := rand.Read(challenge)
+	return challenge, err
+}
+
+func writeHandshake (w io.Writer, msg *handshakeMessage) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return WriteFrame(w, Frame{Type: Handshake, Payload: b})
+}
+
+func readHandshake (r io.Reader) (*handshakeMessage, error) {
+	var f Frame
+	if err := readFrame(r, &f, maxHandshakeFrameSize); err != nil {
+		return nil, err
+	}
+	if f.Type != Handshake {
+		return nil, fmt.Errorf("unexpected frame type (%d) during handshake", f.Type)
+	}
+	msg := &handshakeMessage{}
+	if err := json.Unmarshal(f.Payload, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
@@ -0,0 +1,90 @@
+package p2p
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/priyangshupal/distributed-file-system/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+func newIdentity (t *testing.T) (ed25519.PrivateKey, string) {
+	key, err := crypto.NewIdentityKey()
+	assert.Nil(t, err)
+	return key, crypto.IDFromPublicKey(key.Public().(ed25519.PublicKey))
+}
+
+func TestIdentityHandshake (t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	key1, id1 := newIdentity(t)
+	key2, id2 := newIdentity(t)
+
+	dialer, acceptor := NewTCPPeer(c1, true), NewTCPPeer(c2, false)
+	errch := make(chan error, 1)
+	go func () {
+		errch <- NewHandshakeFunc(HandshakeOpts{IdentityKey: key2, ListenAddr: "10.0.0.2:4000"})(acceptor)
+	}()
+	opts := HandshakeOpts{IdentityKey: key1, ListenAddr: "10.0.0.1:3000", Features: []string{FeatureStreamMux, "other"}}
+	assert.Nil(t, NewHandshakeFunc(opts)(dialer))
+	assert.Nil(t, <- errch)
+
+	assert.Equal(t, id2, dialer.ID())
+	assert.Equal(t, id1, acceptor.ID())
+	assert.Equal(t, "10.0.0.2:4000", dialer.Info().ListenAddr)
+	assert.Equal(t, "10.0.0.1:3000", acceptor.Info().ListenAddr)
+	assert.Equal(t, []string{FeatureStreamMux}, dialer.Info().Features)
+	assert.True(t, acceptor.Info().HasFeature(FeatureStreamMux))
+	assert.False(t, acceptor.Info().HasFeature("other"))
+}
+
+func TestHandshakeIncompatibleVersion (t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	key, _ := newIdentity(t)
+	remoteKey, remoteID := newIdentity(t)
+
+	// a node from the future that dropped support for our version
+	go func () {
+		hello, _ := json.Marshal(Hello{NodeID: remoteID, Version: ProtocolVersion + 2, MinVersion: ProtocolVersion + 1})
+		challenge, _ := newChallenge()
+		pub := remoteKey.Public().(ed25519.PublicKey)
+		writeHandshake(c1, &handshakeMessage{PublicKey: pub, Challenge: challenge, Hello: hello})
+		io.Copy(io.Discard, c1)
+	}()
+
+	err := NewHandshakeFunc(HandshakeOpts{IdentityKey: key})(NewTCPPeer(c2, false))
+	assert.ErrorIs(t, err, ErrIncompatibleVersion)
+}
+
+func TestIdentityHandshakeRejectsUnauthenticatedPeer (t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	key, _ := newIdentity(t)
+
+	// the dialing side never answers the challenge
+	go NOPHandshakeFunc(NewTCPPeer(c1, true))
+	acceptor := NewTCPPeer(c2, false)
+	handshake := NewHandshakeFunc(HandshakeOpts{IdentityKey: key, Timeout: time.Millisecond * 100})
+	assert.ErrorIs(t, handshake(acceptor), ErrHandshakeFailed)
+}
+
+func TestIdentityHandshakeRejectsLargeFrame (t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	key, _ := newIdentity(t)
+
+	// only the header of a huge frame is sent, it is never read
+	go WriteFrame(c1, Frame{Type: Handshake, Payload: make([]byte, maxHandshakeFrameSize + 1)})
+	err := NewHandshakeFunc(HandshakeOpts{IdentityKey: key})(NewTCPPeer(c2, false))
+	assert.ErrorIs(t, err, ErrHandshakeFailed)
+	assert.ErrorContains(t, err, ErrFrameTooLarge.Error())
+}
@@ -0,0 +1,63 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultHeartbeatInterval = time.Second * 5
+	defaultHeartbeatMisses = 3
+)
+
+var ErrHeartbeatTimeout = errors.New("peer stopped answering heartbeats")
+
+// heartbeat keeps track of the liveness of a single connection.
+// Every ping carries the time it was sent at, the pong echoes it
+// back so the round trip time can be measured without keeping
+// any state per ping.
+type heartbeat struct {
+	rtt atomic.Int64
+	// missed is the number of pings sent since the last pong
+	missed atomic.Int32
+}
+
+func (h *heartbeat) RTT () time.Duration {
+	return time.Duration(h.rtt.Load())
+}
+
+func (h *heartbeat) handlePong (payload []byte) error {
+	if len(payload) != 8 {
+		return fmt.Errorf("invalid pong of (%d) bytes", len(payload))
+	}
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64(payload)))
+	h.rtt.Store(int64(time.Since(sent)))
+	h.missed.Store(0)
+	return nil
+}
+
+// run sends a ping every interval until done is closed. It returns
+// ErrHeartbeatTimeout once `misses` pings in a row went unanswered.
+func (h *heartbeat) run (mux *streamMux, interval time.Duration, misses int, done <- chan struct{}) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <- ticker.C:
+		case <- done:
+			return nil
+		}
+		if int(h.missed.Load()) >= misses {
+			return ErrHeartbeatTimeout
+		}
+		payload := make([]byte, 8)
+		binary.BigEndian.PutUint64(payload, uint64(time.Now().UnixNano()))
+		h.missed.Add(1)
+		if err := mux.writeFrame(Frame{Type: Ping, Payload: payload}); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package p2p
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newHeartbeatTransport (t *testing.T, peers chan Peer, gone chan Peer) *TCPTransport {
+	tr := NewTCPTransport(TCPTransportOpts{
+		ListenAddr: "127.0.0.1:0",
+		PeerOpts: PeerOpts{
+			HandshakeFunc: NOPHandshakeFunc,
+			Decoder: DefaultDecoder{},
+			OnPeer: func (p Peer) error { peers <- p; return nil },
+			OnPeerDisconnect: func (p Peer) { gone <- p },
+			HeartbeatInterval: time.Millisecond * 20,
+			HeartbeatMisses: 2,
+		},
+	})
+	assert.Nil(t, tr.ListenAndAccept())
+	t.Cleanup(func () { tr.Close() })
+	return tr
+}
+
+func TestHeartbeatMeasuresRTT (t *testing.T) {
+	peers, gone := make(chan Peer, 2), make(chan Peer, 2)
+	tr1 := newHeartbeatTransport(t, peers, gone)
+	tr2 := newHeartbeatTransport(t, peers, gone)
+	assert.Nil(t, tr2.Dial(tr1.listener.Addr().String()))
+
+	p := <- peers
+	defer p.Close()
+	assert.Eventually(t, func () bool { return p.RTT() > 0 }, time.Second, time.Millisecond * 10)
+
+	// answered pings keep the connection open
+	select {
+	case <- gone:
+		t.Fatal("peer dropped while answering heartbeats")
+	case <- time.After(time.Millisecond * 150):
+	}
+}
+
+func TestHeartbeatDropsSilentPeer (t *testing.T) {
+	peers, gone := make(chan Peer, 1), make(chan Peer, 1)
+	tr := newHeartbeatTransport(t, peers, gone)
+
+	// the remote side never reads, so it never answers a ping
+	conn, err := net.Dial("tcp", tr.listener.Addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	p := <- peers
+	select {
+	case dropped := <- gone:
+		assert.Equal(t, p, dropped)
+	case <- time.After(time.Second):
+		t.Fatal("silent peer was not dropped")
+	}
+}
@@ -0,0 +1,236 @@
+package p2p
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+const defaultInboundQueueSize = 256
+
+var ErrInboundQueueFull = errors.New("inbound queue full")
+
+// OverflowPolicy decides what happens to a message of a peer whose
+// inbound queue is full
+type OverflowPolicy int
+
+const (
+	// OverflowBlock holds the messages of the peer back until its
+	// queue has room again, its streams and heartbeats are served
+	// meanwhile. Once as many messages are held back as the queue
+	// holds, the connection is closed. Other peers are not affected.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDrop drops the message
+	OverflowDrop
+	// OverflowDisconnect closes the connection of the peer
+	OverflowDisconnect
+)
+
+// InboundQueueStats describe the inbound queue of a single connection
+type InboundQueueStats struct {
+	PeerID string
+	RemoteAddr string
+	// Depth is the number of messages waiting to be consumed
+	Depth int
+	Capacity int
+	// Dropped is the number of messages dropped by OverflowDrop
+	Dropped uint64
+}
+
+// inbox gives every connection of a transport its own bounded queue
+// of incoming messages. The queues are drained round robin into the
+// channel returned by Consume, one message per queue at a time, so a
+// peer flooding us can't starve the others.
+type inbox struct {
+	size int
+	policy OverflowPolicy
+	out chan RPC
+	// notify is signalled whenever a message is queued
+	notify chan struct{}
+	quitch chan struct{}
+	closeOnce sync.Once
+
+	mu sync.Mutex
+	queues []*peerQueue
+}
+
+type peerQueue struct {
+	peer *TCPPeer
+	ch chan RPC
+	dropped atomic.Uint64
+	closed atomic.Bool
+
+	mu sync.Mutex
+	// backlog are the messages held back by OverflowBlock
+	backlog []RPC
+}
+
+func newInbox (size int, policy OverflowPolicy) *inbox {
+	if size <= 0 {
+		size = defaultInboundQueueSize
+	}
+	in := &inbox{
+		size: size,
+		policy: policy,
+		out: make(chan RPC),
+		notify: make(chan struct{}, 1),
+		quitch: make(chan struct{}),
+	}
+	go in.run()
+	return in
+}
+
+// register creates the queue of a new connection
+func (in *inbox) register (peer *TCPPeer) *peerQueue {
+	q := &peerQueue{peer: peer, ch: make(chan RPC, in.size)}
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.queues = append(in.queues, q)
+	return q
+}
+
+// unregister is called once the connection is gone. The messages
+// still in the queue are delivered before it is removed.
+func (in *inbox) unregister (q *peerQueue) {
+	q.closed.Store(true)
+	in.signal()
+}
+
+// push queues a message of the peer, applying the overflow policy
+// when its queue is full. It never blocks, so the read loop keeps
+// serving the other frames of the connection. An error means the
+// connection has to be closed.
+func (in *inbox) push (q *peerQueue, rpc RPC) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	// messages never overtake the ones held back
+	if len(q.backlog) == 0 {
+		select {
+		case q.ch <- rpc:
+			in.signal()
+			return nil
+		default:
+		}
+	}
+	switch in.policy {
+	case OverflowDrop:
+		q.dropped.Add(1)
+		return nil
+	case OverflowDisconnect:
+		return ErrInboundQueueFull
+	}
+	if len(q.backlog) >= cap(q.ch) {
+		return ErrInboundQueueFull
+	}
+	q.backlog = append(q.backlog, rpc)
+	if len(q.backlog) == 1 {
+		go in.deliver(q)
+	}
+	return nil
+}
+
+// deliver moves the messages held back into the queue as it drains,
+// until none are left or the connection or the inbox is closed
+func (in *inbox) deliver (q *peerQueue) {
+	for {
+		q.mu.Lock()
+		rpc := q.backlog[0]
+		q.mu.Unlock()
+		select {
+		case q.ch <- rpc:
+			in.signal()
+		case <- q.peer.mux.done:
+			return
+		case <- in.quitch:
+			return
+		}
+		q.mu.Lock()
+		q.backlog = q.backlog[1:]
+		empty := len(q.backlog) == 0
+		q.mu.Unlock()
+		if empty {
+			return
+		}
+	}
+}
+
+func (in *inbox) signal () {
+	select {
+	case in.notify <- struct{}{}:
+	default:
+	}
+}
+
+// run hands the queued messages to the consumer, taking one message
+// from every queue in turn
+func (in *inbox) run () {
+	for {
+		in.mu.Lock()
+		queues := append([]*peerQueue{}, in.queues...)
+		in.mu.Unlock()
+
+		delivered := false
+		for _, q := range queues {
+			select {
+			case rpc := <- q.ch:
+				select {
+				case in.out <- rpc:
+				case <- in.quitch:
+					return
+				}
+				delivered = true
+			default:
+				if q.closed.Load() && len(q.ch) == 0 {
+					in.remove(q)
+				}
+			}
+		}
+		if !delivered {
+			select {
+			case <- in.notify:
+			case <- in.quitch:
+				return
+			}
+		}
+	}
+}
+
+// close stops handing out messages, the messages still queued are dropped
+func (in *inbox) close () {
+	in.closeOnce.Do(func () {
+		close(in.quitch)
+	})
+}
+
+func (in *inbox) remove (q *peerQueue) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	for i, other := range in.queues {
+		if other == q {
+			in.queues = append(in.queues[:i], in.queues[i + 1:]...)
+			return
+		}
+	}
+}
+
+func (q *peerQueue) held () int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.backlog)
+}
+
+func (in *inbox) stats () []InboundQueueStats {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	stats := make([]InboundQueueStats, 0, len(in.queues))
+	for _, q := range in.queues {
+		stats = append(stats, InboundQueueStats{
+			PeerID: q.peer.ID(),
+			RemoteAddr: q.peer.RemoteAddr().String(),
+			Depth: len(q.ch) + q.held(),
+			Capacity: cap(q.ch),
+			Dropped: q.dropped.Load(),
+		})
+	}
+	return stats
+}
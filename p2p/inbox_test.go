@@ -0,0 +1,73 @@
+package p2p
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newInboxPeer (t *testing.T) *TCPPeer {
+	c1, c2 := net.Pipe()
+	t.Cleanup(func () {
+		c1.Close()
+		c2.Close()
+	})
+	return NewTCPPeer(c1, true)
+}
+
+func TestInboxFairness (t *testing.T) {
+	in := newInbox(100, OverflowBlock)
+	chatty, quiet := in.register(newInboxPeer(t)), in.register(newInboxPeer(t))
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, in.push(chatty, RPC{From: "chatty"}))
+	}
+	assert.Nil(t, in.push(quiet, RPC{From: "quiet"}))
+
+	// the quiet peer doesn't wait for the whole backlog of the chatty one
+	for i := 0; i < 3; i++ {
+		if rpc := <- in.out; rpc.From == "quiet" {
+			return
+		}
+	}
+	t.Fatal("message of the quiet peer was not delivered")
+}
+
+func TestInboxOverflow (t *testing.T) {
+	drop := newInbox(2, OverflowDrop)
+	q := drop.register(newInboxPeer(t))
+	// nobody consumes, the dispatcher holds on to the first message
+	assert.Nil(t, drop.push(q, RPC{}))
+	assert.Eventually(t, func () bool { return len(q.ch) == 0 }, time.Second, time.Millisecond)
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, drop.push(q, RPC{}))
+	}
+	stats := drop.stats()
+	assert.Len(t, stats, 1)
+	assert.Equal(t, 2, stats[0].Depth)
+	assert.Equal(t, uint64(8), stats[0].Dropped)
+
+	disconnect := newInbox(2, OverflowDisconnect)
+	q = disconnect.register(newInboxPeer(t))
+	var err error
+	for i := 0; i < 10 && err == nil; i++ {
+		err = disconnect.push(q, RPC{})
+	}
+	assert.ErrorIs(t, err, ErrInboundQueueFull)
+
+	// the read loop never blocks, messages are held back in order
+	// until as many are held back as the queue holds
+	block := newInbox(2, OverflowBlock)
+	q = block.register(newInboxPeer(t))
+	assert.Nil(t, block.push(q, RPC{Payload: []byte{0}}))
+	assert.Eventually(t, func () bool { return len(q.ch) == 0 }, time.Second, time.Millisecond)
+	for i := 1; i < 5; i++ {
+		assert.Nil(t, block.push(q, RPC{Payload: []byte{byte(i)}}))
+	}
+	assert.ErrorIs(t, block.push(q, RPC{}), ErrInboundQueueFull)
+	assert.Equal(t, 4, block.stats()[0].Depth)
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, []byte{byte(i)}, (<- block.out).Payload)
+	}
+}
@@ -0,0 +1,141 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+var (
+	ErrAddrInUse = errors.New("address already in use")
+	ErrNoListener = errors.New("no transport listening on address")
+)
+
+// MemNetwork connects the MemTransports of a single process. Each
+// test creates its own network, so tests never share addresses.
+type MemNetwork struct {
+	mu sync.Mutex
+	listeners map[string]*MemTransport
+	nextConn uint64
+}
+
+func NewMemNetwork () *MemNetwork {
+	return &MemNetwork{
+		listeners: make(map[string]*MemTransport),
+	}
+}
+
+func (n *MemNetwork) listen (t *MemTransport) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.listeners[t.ListenAddr]; ok {
+		return fmt.Errorf("%w: %s", ErrAddrInUse, t.ListenAddr)
+	}
+	n.listeners[t.ListenAddr] = t
+	return nil
+}
+
+func (n *MemNetwork) unlisten (t *MemTransport) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.listeners[t.ListenAddr] == t {
+		delete(n.listeners, t.ListenAddr)
+	}
+}
+
+// dial connects the two sides of an in-memory pipe
+func (n *MemNetwork) dial (from *MemTransport, addr string) (net.Conn, *MemTransport, net.Conn, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	remote, ok := n.listeners[addr]
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("%w: %s", ErrNoListener, addr)
+	}
+	n.nextConn++
+	// every connection gets its own local address, like the
+	// ephemeral port of a TCP connection
+	local := memAddr(fmt.Sprintf("%s#%d", from.ListenAddr, n.nextConn))
+	c1, c2 := net.Pipe()
+	return &namedConn{Conn: c1, local: local, remote: memAddr(addr)}, remote,
+		&namedConn{Conn: c2, local: memAddr(addr), remote: local}, nil
+}
+
+type MemTransportOpts struct {
+	PeerOpts
+	// Network is the network the transport listens on and dials into
+	Network *MemNetwork
+	// ListenAddr is any name that is unique within the network
+	ListenAddr string
+}
+
+// MemTransport is a Transport over in-memory pipes. It behaves like
+// TCPTransport, handshake and stream multiplexing included, but
+// never touches the network, which makes it a good fit for tests
+// that run whole clusters in a single process.
+type MemTransport struct {
+	MemTransportOpts
+	baseTransport
+}
+
+func NewMemTransport (opts MemTransportOpts) *MemTransport {
+	t := &MemTransport{
+		MemTransportOpts: opts,
+	}
+	t.init(&t.PeerOpts)
+	return t
+}
+
+func (t *MemTransport) Addr () string {
+	return t.ListenAddr
+}
+
+// ListenAndAccept registers the transport on its network
+func (t *MemTransport) ListenAndAccept () error {
+	return t.Network.listen(t)
+}
+
+// Close stops accepting connections. Like for TCPTransport,
+// established connections stay open.
+func (t *MemTransport) Close () error {
+	t.Network.unlisten(t)
+	return nil
+}
+
+// Shutdown implements the Transport interface
+func (t *MemTransport) Shutdown (ctx context.Context) error {
+	return t.shutdown(ctx, t.Close)
+}
+
+// Dial connects to the transport listening on addr in the same network
+func (t *MemTransport) Dial (addr string) error {
+	local, remote, remoteConn, err := t.Network.dial(t, addr)
+	if err != nil {
+		return err
+	}
+	if !t.conns.track(local) {
+		local.Close()
+		remoteConn.Close()
+		return ErrTransportClosed
+	}
+	if !remote.conns.track(remoteConn) {
+		t.conns.untrack(local)
+		local.Close()
+		remoteConn.Close()
+		return fmt.Errorf("%w: %s", ErrNoListener, addr)
+	}
+	go remote.handleConn(remoteConn, false)
+	go t.handleConn(local, true)
+	return nil
+}
+
+func (t *MemTransport) handleConn (conn net.Conn, outbound bool) {
+	defer t.conns.untrack(conn)
+	t.serve(conn, outbound, t.ListenAddr)
+}
+
+type memAddr string
+
+func (a memAddr) Network () string { return "mem" }
+func (a memAddr) String () string { return string(a) }
@@ -0,0 +1,87 @@
+package p2p
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemTransport (t *testing.T) {
+	network := NewMemNetwork()
+	peers := make(chan Peer, 2)
+	onPeer := func (p Peer) error { peers <- p; return nil }
+	tr1 := NewMemTransport(MemTransportOpts{Network: network, ListenAddr: "node1", PeerOpts: PeerOpts{OnPeer: onPeer}})
+	tr2 := NewMemTransport(MemTransportOpts{Network: network, ListenAddr: "node2", PeerOpts: PeerOpts{OnPeer: onPeer}})
+	assert.Nil(t, tr1.ListenAndAccept())
+	assert.Nil(t, tr2.ListenAndAccept())
+	assert.ErrorIs(t, NewMemTransport(MemTransportOpts{Network: network, ListenAddr: "node1"}).ListenAndAccept(), ErrAddrInUse)
+	assert.ErrorIs(t, tr1.Dial("node3"), ErrNoListener)
+
+	assert.Nil(t, tr1.Dial("node2"))
+	p1, p2 := <- peers, <- peers
+	if !p1.Outbound() {
+		p1, p2 = p2, p1
+	}
+	assert.Equal(t, "node2", p1.RemoteAddr().String())
+	assert.Equal(t, p1.LocalAddr().String(), p2.RemoteAddr().String())
+
+	go p1.Send([]byte("hello"))
+	rpc := <- tr2.Consume()
+	assert.Equal(t, []byte("hello"), rpc.Payload)
+	assert.Equal(t, p2.ID(), rpc.From)
+
+	st, err := p1.OpenStream()
+	assert.Nil(t, err)
+	go func () {
+		st.Write([]byte("over a stream"))
+		st.Close()
+	}()
+	go p1.Send([]byte("stream opened"))
+	<- tr2.Consume()
+	remote, err := p2.AcceptStream(st.ID())
+	assert.Nil(t, err)
+	b, err := io.ReadAll(remote)
+	assert.Nil(t, err)
+	assert.Equal(t, "over a stream", string(b))
+}
+
+func TestMemTransportStreamsWhileQueueFull (t *testing.T) {
+	network := NewMemNetwork()
+	peers := make(chan Peer, 2)
+	opts := PeerOpts{OnPeer: func (p Peer) error { peers <- p; return nil }, InboundQueueSize: 2}
+	tr1 := NewMemTransport(MemTransportOpts{Network: network, ListenAddr: "node1", PeerOpts: opts})
+	tr2 := NewMemTransport(MemTransportOpts{Network: network, ListenAddr: "node2", PeerOpts: opts})
+	assert.Nil(t, tr2.ListenAndAccept())
+	assert.Nil(t, tr1.Dial("node2"))
+	p1, p2 := <- peers, <- peers
+	if !p1.Outbound() {
+		p1, p2 = p2, p1
+	}
+
+	// nobody consumes the messages of node1 on node2, its streams
+	// still make progress
+	for i := 0; i < 4; i++ {
+		assert.Nil(t, p1.Send([]byte("queued")))
+	}
+	st, err := p1.OpenStream()
+	assert.Nil(t, err)
+	payload := make([]byte, streamWindowSize * 2)
+	go func () {
+		st.Write(payload)
+		st.Close()
+	}()
+	var remote Stream
+	assert.Eventually(t, func () bool {
+		remote, err = p2.AcceptStream(st.ID())
+		return err == nil
+	}, time.Second, time.Millisecond * 5)
+	b, err := io.ReadAll(remote)
+	assert.Nil(t, err)
+	assert.Len(t, b, len(payload))
+
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, []byte("queued"), (<- tr2.Consume()).Payload)
+	}
+}
@@ -1,12 +1,18 @@
 package p2p
 
+// Frame types
 const (
 	IncomingMessage = 1
-	IncomingStream = 2
+	StreamOpen = 2
+	StreamData = 3
+	StreamClose = 4
+	StreamWindowUpdate = 5
+	Handshake = 6
+	Ping = 7
+	Pong = 8
 )
 
 type RPC struct {
 	From string
 	Payload []byte
-	Stream bool
-}
\ No newline at end of file
+}
@@ -0,0 +1,31 @@
+//go:build linux
+
+package p2p
+
+import (
+	"net"
+	"syscall"
+)
+
+// peerUID returns the user of the process at the other end of the
+// connection, as recorded by the kernel when it connected
+func peerUID (conn *net.UnixConn) (uint32, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var (
+		cred *syscall.Ucred
+		credErr error
+	)
+	err = raw.Control(func (fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if credErr != nil {
+		return 0, credErr
+	}
+	return cred.Uid, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package p2p
+
+import (
+	"errors"
+	"net"
+)
+
+// peerUID is only implemented on Linux, connections are rejected
+// elsewhere when UnixTransportOpts.AllowedUIDs is set
+func peerUID (conn *net.UnixConn) (uint32, error) {
+	return 0, errors.New("peer credentials are not supported on this platform")
+}
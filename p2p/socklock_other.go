@@ -0,0 +1,11 @@
+//go:build !unix
+
+package p2p
+
+import "os"
+
+// lockSocket is only implemented on Unix, elsewhere a socket file
+// left behind has to be removed by hand
+func lockSocket (path string) (*os.File, error) {
+	return nil, nil
+}
@@ -0,0 +1,28 @@
+//go:build unix
+
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// lockSocket takes the lock file next to the socket at path. The
+// lock is held for as long as the returned file is open, so it is
+// released even when the process crashes.
+func lockSocket (path string) (*os.File, error) {
+	f, err := os.OpenFile(path + ".lock", os.O_RDWR | os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX | syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("%w: %s", ErrAddrInUse, path)
+		}
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,545 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// streamWindowSize is the number of bytes a stream may have in
+	// flight before the sender has to wait for a window update
+	streamWindowSize = 256 * 1024
+	// maxStreamChunk is the largest payload of a single data frame
+	maxStreamChunk = 32 * 1024
+	// outboundQueueSize is the number of frames that may wait for
+	// the writer of a connection before writeFrame blocks
+	outboundQueueSize = 64
+	// maxRemoteStreams is the number of streams the remote peer may
+	// have open at once, the streams it opens beyond are reset
+	maxRemoteStreams = 128
+	// streamAcceptTimeout is how long a stream opened by the remote
+	// peer is kept for being accepted before it is reset
+	streamAcceptTimeout = time.Second * 30
+)
+
+var (
+	ErrStreamClosed = errors.New("stream closed")
+	ErrPeerClosed = errors.New("peer connection closed")
+)
+
+// Stream is a single flow controlled byte stream multiplexed over
+// the connection of a peer. Any number of streams can be open on
+// the same peer at once without blocking each other or the control
+// messages.
+type Stream interface {
+	io.ReadWriteCloser
+	ID() uint32
+}
+
+// streamMux keeps track of all the streams of a single connection.
+// The dialing side of the connection opens streams with odd ids and
+// the accepting side with even ids, so both sides can open streams
+// without coordinating. Id 0 is reserved for control messages.
+//
+// All the frames of the connection are written by a single writer
+// goroutine fed by a bounded queue, so frames are never interleaved
+// and a slow peer blocks its writers instead of piling up frames.
+type streamMux struct {
+	w io.Writer
+	writech chan outFrame
+	// done is closed together with the mux
+	done chan struct{}
+
+	mu sync.Mutex
+	streams map[uint32]*stream
+	nextID uint32
+	// err is set once the underlying connection is gone
+	err error
+	acceptTimeout time.Duration
+
+	// compress is set when both sides support FeatureCompression
+	compress atomic.Bool
+	stats compressionStats
+}
+
+func newStreamMux (w io.Writer, outbound bool) *streamMux {
+	nextID := uint32(2)
+	if outbound {
+		nextID = 1
+	}
+	m := &streamMux{
+		w: w,
+		writech: make(chan outFrame, outboundQueueSize),
+		done: make(chan struct{}),
+		streams: make(map[uint32]*stream),
+		nextID: nextID,
+		acceptTimeout: streamAcceptTimeout,
+	}
+	go m.writeLoop()
+	return m
+}
+
+// outFrame is an encoded frame waiting for the writer. The result of
+// the write is reported on written when it is set.
+type outFrame struct {
+	b []byte
+	written chan error
+}
+
+// writeFrame queues the frame for the writer of the connection. It
+// blocks while the queue is full and fails once the mux is closed.
+func (m *streamMux) writeFrame (f Frame) error {
+	return m.queue(f, nil)
+}
+
+// sendFrame queues the frame like writeFrame, then waits until the
+// writer wrote it and returns the result of the write
+func (m *streamMux) sendFrame (f Frame) error {
+	written := make(chan error, 1)
+	if err := m.queue(f, written); err != nil {
+		return err
+	}
+	select {
+	case err := <- written:
+		return err
+	case <- m.done:
+	}
+	// the frame may have been written right before the mux closed
+	select {
+	case err := <- written:
+		return err
+	default:
+		return m.closeErr()
+	}
+}
+
+func (m *streamMux) queue (f Frame, written chan error) error {
+	b, err := encodeFrame(f)
+	if err != nil {
+		return err
+	}
+	select {
+	case <- m.done:
+		return m.closeErr()
+	default:
+	}
+	select {
+	case m.writech <- outFrame{b: b, written: written}:
+		return nil
+	case <- m.done:
+		return m.closeErr()
+	}
+}
+
+// writeLoop writes the queued frames until the mux is closed. A failed
+// write closes the connection, which ends its read loop as well.
+func (m *streamMux) writeLoop () {
+	for {
+		select {
+		case f := <- m.writech:
+			_, err := m.w.Write(f.b)
+			if f.written != nil {
+				f.written <- err
+			}
+			if err != nil {
+				m.close(err)
+				if c, ok := m.w.(io.Closer); ok {
+					c.Close()
+				}
+				return
+			}
+		case <- m.done:
+			return
+		}
+	}
+}
+
+func (m *streamMux) closeErr () error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+func (m *streamMux) open () (*stream, error) {
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return nil, m.err
+	}
+	id := m.nextID
+	m.nextID += 2
+	st := newStream(id, m)
+	st.accepted = true
+	m.streams[id] = st
+	m.mu.Unlock()
+
+	if err := m.writeFrame(Frame{Type: StreamOpen, StreamID: id}); err != nil {
+		m.remove(id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// accept hands out a stream opened by the remote peer. Every remote
+// stream can only be accepted once.
+func (m *streamMux) accept (id uint32) (*stream, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return nil, m.err
+	}
+	st, ok := m.streams[id]
+	if !ok || st.accepted {
+		return nil, fmt.Errorf("stream (%d) was not opened by the remote peer", id)
+	}
+	st.accepted = true
+	st.expire.Stop()
+	return st, nil
+}
+
+// expire resets the stream opened by the remote peer unless it has
+// been accepted meanwhile. Nobody is going to read it, so the data
+// buffered for it is dropped and the remote stops writing it.
+func (m *streamMux) expire (id uint32) {
+	m.mu.Lock()
+	st, ok := m.streams[id]
+	if !ok || st.accepted {
+		m.mu.Unlock()
+		return
+	}
+	delete(m.streams, id)
+	m.mu.Unlock()
+
+	st.fail(fmt.Errorf("stream (%d) was not accepted in time: %w", id, ErrStreamClosed))
+	m.writeFrame(Frame{Type: StreamClose, StreamID: id})
+}
+
+// remoteStreams must be called with m.mu held
+func (m *streamMux) remoteStreams () int {
+	n := 0
+	for id := range m.streams {
+		if id % 2 != m.nextID % 2 {
+			n++
+		}
+	}
+	return n
+}
+
+func (m *streamMux) get (id uint32) *stream {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.streams[id]
+}
+
+func (m *streamMux) remove (id uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.streams, id)
+}
+
+// handleFrame is called by the read loop of the connection for
+// every frame that belongs to a stream
+func (m *streamMux) handleFrame (f Frame) error {
+	if f.Type == StreamOpen {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if _, ok := m.streams[f.StreamID]; ok || f.StreamID % 2 == m.nextID % 2 {
+			return fmt.Errorf("invalid stream id (%d) opened by remote", f.StreamID)
+		}
+		if m.remoteStreams() >= maxRemoteStreams {
+			// the frames that follow for the stream are ignored
+			go m.writeFrame(Frame{Type: StreamClose, StreamID: f.StreamID})
+			return nil
+		}
+		st := newStream(f.StreamID, m)
+		id := f.StreamID
+		st.expire = time.AfterFunc(m.acceptTimeout, func () {
+			m.expire(id)
+		})
+		m.streams[f.StreamID] = st
+		return nil
+	}
+
+	st := m.get(f.StreamID)
+	if st == nil {
+		// the stream has been closed on both sides already
+		return nil
+	}
+
+	switch f.Type {
+	case StreamData:
+		data := f.Payload
+		if f.Flags & FlagCompressed != 0 {
+			var err error
+			if data, err = decompressChunk(data, maxStreamChunk); err != nil {
+				return fmt.Errorf("stream (%d): %w", f.StreamID, err)
+			}
+		}
+		return st.push(data)
+	case StreamWindowUpdate:
+		if len(f.Payload) != 4 {
+			return fmt.Errorf("invalid window update for stream (%d)", f.StreamID)
+		}
+		st.grow(binary.BigEndian.Uint32(f.Payload))
+		return nil
+	case StreamClose:
+		st.closeRemote()
+		m.dropUnaccepted(st)
+		return nil
+	}
+	return fmt.Errorf("unknown frame type (%d)", f.Type)
+}
+
+// dropUnaccepted removes a stream closed by the remote peer before it
+// was accepted, unless there is data left to read on it. Such streams
+// are removed once they expire.
+func (m *streamMux) dropUnaccepted (st *stream) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if st.accepted || st.buffered() > 0 {
+		return
+	}
+	st.expire.Stop()
+	delete(m.streams, st.id)
+}
+
+// close fails all the streams of the connection
+func (m *streamMux) close (err error) {
+	if err == nil {
+		err = ErrPeerClosed
+	}
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return
+	}
+	m.err = err
+	close(m.done)
+	streams := m.streams
+	m.streams = make(map[uint32]*stream)
+	m.mu.Unlock()
+
+	for _, st := range streams {
+		st.fail(err)
+	}
+}
+
+type stream struct {
+	id uint32
+	mux *streamMux
+	// accepted is guarded by mux.mu
+	accepted bool
+	// expire resets a stream opened by the remote peer that is not
+	// accepted in time, nil for the streams opened locally
+	expire *time.Timer
+
+	mu sync.Mutex
+	cond *sync.Cond
+	buf bytes.Buffer
+	// sendWindow is the number of bytes we may still send
+	sendWindow uint32
+	// recvWindow is the number of bytes the remote may still send
+	recvWindow uint32
+	// consumed is the number of bytes read since the last window update
+	consumed uint32
+	localClosed bool
+	remoteClosed bool
+	err error
+	// incompressible is the number of chunks in a row that did
+	// not compress, only used by Write
+	incompressible int
+}
+
+func newStream (id uint32, m *streamMux) *stream {
+	st := &stream{
+		id: id,
+		mux: m,
+		sendWindow: streamWindowSize,
+		recvWindow: streamWindowSize,
+	}
+	st.cond = sync.NewCond(&st.mu)
+	return st
+}
+
+func (s *stream) ID () uint32 {
+	return s.id
+}
+
+// Read returns the buffered data of the stream. Once the remote
+// peer has closed the stream and everything is read, it returns io.EOF
+func (s *stream) Read (b []byte) (int, error) {
+	s.mu.Lock()
+	for s.buf.Len() == 0 {
+		switch {
+		case s.localClosed:
+			s.mu.Unlock()
+			return 0, ErrStreamClosed
+		case s.remoteClosed:
+			s.mu.Unlock()
+			return 0, io.EOF
+		case s.err != nil:
+			err := s.err
+			s.mu.Unlock()
+			return 0, err
+		}
+		s.cond.Wait()
+	}
+	n, _ := s.buf.Read(b)
+	s.consumed += uint32(n)
+
+	// give the consumed bytes back to the sender once half of
+	// the window has been read
+	var update uint32
+	if s.consumed >= streamWindowSize / 2 && !s.remoteClosed {
+		update = s.consumed
+		s.consumed = 0
+		s.recvWindow += update
+	}
+	s.mu.Unlock()
+
+	if update > 0 {
+		payload := make([]byte, 4)
+		binary.BigEndian.PutUint32(payload, update)
+		s.mux.writeFrame(Frame{Type: StreamWindowUpdate, StreamID: s.id, Payload: payload})
+	}
+	return n, nil
+}
+
+// Write splits b into data frames, blocking whenever the send
+// window of the stream is exhausted
+func (s *stream) Write (b []byte) (int, error) {
+	total := 0
+	for len(b) > 0 {
+		s.mu.Lock()
+		for s.sendWindow == 0 && s.writeErr() == nil {
+			s.cond.Wait()
+		}
+		if err := s.writeErr(); err != nil {
+			s.mu.Unlock()
+			return total, err
+		}
+		n := min(len(b), maxStreamChunk, int(s.sendWindow))
+		s.sendWindow -= uint32(n)
+		s.mu.Unlock()
+
+		f := Frame{Type: StreamData, StreamID: s.id, Payload: b[:n]}
+		if s.mux.compress.Load() {
+			s.compress(&f)
+		}
+		if err := s.mux.writeFrame(f); err != nil {
+			return total, err
+		}
+		total += n
+		b = b[n:]
+	}
+	return total, nil
+}
+
+// compress replaces the payload of the data frame by its compressed
+// form, unless the data of the stream turns out to be incompressible
+func (s *stream) compress (f *Frame) {
+	in := len(f.Payload)
+	try := in >= minCompressSize &&
+		(s.incompressible < incompressibleLimit || s.incompressible % incompressibleProbe == 0)
+	if try {
+		if b, ok := compressChunk(f.Payload); ok {
+			f.Payload = b
+			f.Flags |= FlagCompressed
+			s.incompressible = 0
+		} else {
+			s.incompressible++
+		}
+	} else if in >= minCompressSize {
+		s.incompressible++
+	}
+	s.mux.stats.add(in, len(f.Payload), f.Flags & FlagCompressed != 0)
+}
+
+// writeErr must be called with s.mu held
+func (s *stream) writeErr () error {
+	switch {
+	case s.localClosed:
+		return ErrStreamClosed
+	case s.remoteClosed:
+		return fmt.Errorf("stream (%d) closed by remote peer: %w", s.id, ErrStreamClosed)
+	}
+	return s.err
+}
+
+// Close tells the remote peer that we are neither reading nor
+// writing the stream anymore. Data the remote has already sent
+// is discarded.
+func (s *stream) Close () error {
+	s.mu.Lock()
+	if s.localClosed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.localClosed = true
+	s.buf.Reset()
+	remoteClosed, failed := s.remoteClosed, s.err != nil
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	if remoteClosed || failed {
+		s.mux.remove(s.id)
+	}
+	if failed {
+		return nil
+	}
+	return s.mux.writeFrame(Frame{Type: StreamClose, StreamID: s.id})
+}
+
+func (s *stream) push (data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if uint32(len(data)) > s.recvWindow {
+		return fmt.Errorf("stream (%d) exceeded its flow control window", s.id)
+	}
+	s.recvWindow -= uint32(len(data))
+	if s.localClosed {
+		// nobody is going to read it
+		return nil
+	}
+	s.buf.Write(data)
+	s.cond.Broadcast()
+	return nil
+}
+
+func (s *stream) buffered () int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.Len()
+}
+
+func (s *stream) grow (n uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sendWindow += n
+	s.cond.Broadcast()
+}
+
+func (s *stream) closeRemote () {
+	s.mu.Lock()
+	s.remoteClosed = true
+	localClosed := s.localClosed
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	if localClosed {
+		s.mux.remove(s.id)
+	}
+}
+
+func (s *stream) fail (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+	s.cond.Broadcast()
+}
@@ -0,0 +1,188 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// serveMux runs a minimal read loop that feeds stream frames to m
+// and reports the ids of the streams opened by the remote on opened
+func serveMux (conn net.Conn, m *streamMux, opened chan uint32) {
+	for {
+		var f Frame
+		if err := ReadFrame(conn, &f); err != nil {
+			m.close(err)
+			return
+		}
+		if err := m.handleFrame(f); err != nil {
+			m.close(err)
+			return
+		}
+		if f.Type == StreamOpen && opened != nil {
+			opened <- f.StreamID
+		}
+	}
+}
+
+func TestStreamMuxConcurrentStreams (t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	dialer, acceptor := newStreamMux(c1, true), newStreamMux(c2, false)
+	opened := make(chan uint32, 4)
+	go serveMux(c1, dialer, nil)
+	go serveMux(c2, acceptor, opened)
+
+	// every payload is larger than the flow control window
+	const streams = 4
+	payloads := make([][]byte, streams)
+	index := make(map[uint32]int)
+	for i := range payloads {
+		payloads[i] = make([]byte, streamWindowSize * 3)
+		rand.Read(payloads[i])
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < streams; i++ {
+		st, err := dialer.open()
+		assert.Nil(t, err)
+		index[st.ID()] = i
+		wg.Add(1)
+		go func (i int) {
+			defer wg.Done()
+			_, err := st.Write(payloads[i])
+			assert.Nil(t, err)
+			assert.Nil(t, st.Close())
+		}(i)
+	}
+
+	for i := 0; i < streams; i++ {
+		id := <- opened
+		st, err := acceptor.accept(id)
+		assert.Nil(t, err)
+		wg.Add(1)
+		go func (i int) {
+			defer wg.Done()
+			b, err := io.ReadAll(st)
+			assert.Nil(t, err)
+			assert.True(t, bytes.Equal(payloads[i], b))
+			st.Close()
+		}(index[id])
+	}
+	wg.Wait()
+}
+
+func TestStreamMuxPeerClosed (t *testing.T) {
+	c1, c2 := net.Pipe()
+	dialer, acceptor := newStreamMux(c1, true), newStreamMux(c2, false)
+	go serveMux(c1, dialer, nil)
+	go serveMux(c2, acceptor, nil)
+
+	st, err := dialer.open()
+	assert.Nil(t, err)
+
+	c2.Close()
+	_, err = st.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+	_, err = dialer.open()
+	assert.NotNil(t, err)
+}
+
+func TestStreamMuxUnacceptedStreams (t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	dialer, acceptor := newStreamMux(c1, true), newStreamMux(c2, false)
+	acceptor.acceptTimeout = time.Millisecond * 100
+	opened := make(chan uint32, maxRemoteStreams + 1)
+	go serveMux(c1, dialer, nil)
+	go serveMux(c2, acceptor, opened)
+	remote := func () int {
+		acceptor.mu.Lock()
+		defer acceptor.mu.Unlock()
+		return acceptor.remoteStreams()
+	}
+
+	// a stream nobody accepts is reset, which fails the writer once
+	// the window is full
+	st, err := dialer.open()
+	assert.Nil(t, err)
+	_, err = st.Write(make([]byte, streamWindowSize * 2))
+	assert.ErrorIs(t, err, ErrStreamClosed)
+	assert.Equal(t, 0, remote())
+	_, err = acceptor.accept(<- opened)
+	assert.NotNil(t, err)
+	st.Close()
+
+	// a stream closed before it was accepted is gone right away
+	st, err = dialer.open()
+	assert.Nil(t, err)
+	<- opened
+	assert.Nil(t, st.Close())
+	assert.Eventually(t, func () bool { return remote() == 0 }, time.Millisecond * 50, time.Millisecond)
+
+	// the remote can't open more than maxRemoteStreams at once
+	acceptor.mu.Lock()
+	acceptor.acceptTimeout = time.Minute
+	acceptor.mu.Unlock()
+	for i := 0; i < maxRemoteStreams; i++ {
+		_, err := dialer.open()
+		assert.Nil(t, err)
+		<- opened
+	}
+	st, err = dialer.open()
+	assert.Nil(t, err)
+	_, err = st.Write(make([]byte, streamWindowSize * 2))
+	assert.ErrorIs(t, err, ErrStreamClosed)
+	assert.Equal(t, maxRemoteStreams, remote())
+}
+
+func TestStreamMuxWriterBackpressure (t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	m := newStreamMux(c1, true)
+
+	// nobody reads c2, so the writer is stuck on the first frame
+	// and the queue fills up behind it
+	frames := outboundQueueSize + 2
+	queued := make(chan struct{})
+	go func () {
+		for i := 0; i < frames; i++ {
+			m.writeFrame(Frame{Type: IncomingMessage, Payload: []byte{byte(i)}})
+		}
+		close(queued)
+	}()
+	select {
+	case <- queued:
+		t.Fatal("writeFrame did not block on a full queue")
+	case <- time.After(time.Millisecond * 50):
+	}
+
+	// the frames arrive whole and in queue order
+	for i := 0; i < frames; i++ {
+		var f Frame
+		assert.Nil(t, ReadFrame(c2, &f))
+		assert.Equal(t, []byte{byte(i)}, f.Payload)
+	}
+	<- queued
+}
+
+func TestSendReportsWriteErrors (t *testing.T) {
+	c1, c2 := net.Pipe()
+	p := NewTCPPeer(c1, true)
+	go io.Copy(io.Discard, c2)
+	assert.Nil(t, p.Send([]byte("delivered")))
+
+	// the frame is queued, but the write fails
+	c2.Close()
+	assert.ErrorIs(t, p.Send([]byte("lost")), io.ErrClosedPipe)
+	assert.NotNil(t, p.Send([]byte("after")))
+}
@@ -1,84 +1,171 @@
 package p2p
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"log"
 	"net"
-	"sync"
+	"time"
 )
 
 // This represents a remote node on a TCP connection
 type TCPPeer struct {
-	// the underlying connection of the peer
-	net.Conn
+	// the underlying connection of the peer, all writes go
+	// through the writer of mux
+	conn net.Conn
 	// if we dial a connection => outbound = true
 	// if we accept a connection => outbound = false
 	outbound bool
+	// id is set by the handshake once the identity of the
+	// remote node has been verified
+	id string
+	info PeerInfo
 
-	wg *sync.WaitGroup
+	mux *streamMux
+	heartbeat
 }
 
 func NewTCPPeer (conn net.Conn, outbound bool) *TCPPeer {
 	return &TCPPeer{
-		Conn: conn,
+		conn: conn,
 		outbound: outbound,
-		wg: &sync.WaitGroup{},
+		mux: newStreamMux(conn, outbound),
 	}
 }
 
-func (p *TCPPeer) CloseStream () {
-	p.wg.Done()
+func (p *TCPPeer) ID () string {
+	if len(p.id) == 0 {
+		return p.RemoteAddr().String()
+	}
+	return p.id
+}
+
+func (p *TCPPeer) LocalAddr () net.Addr {
+	return p.conn.LocalAddr()
+}
+
+func (p *TCPPeer) RemoteAddr () net.Addr {
+	return p.conn.RemoteAddr()
+}
+
+// Close closes the connection, which fails its streams and ends
+// its read loop
+func (p *TCPPeer) Close () error {
+	return p.conn.Close()
+}
+
+func (p *TCPPeer) setID (id string) {
+	p.id = id
+}
+
+func (p *TCPPeer) Info () PeerInfo {
+	return p.info
+}
+
+func (p *TCPPeer) setInfo (info PeerInfo) {
+	p.info = info
 }
 
-// Send function writes bytes to the connection for the other
-// peer to read
+func (p *TCPPeer) CompressionStats () CompressionStats {
+	return p.mux.stats.snapshot()
+}
+
+func (p *TCPPeer) Outbound () bool {
+	return p.outbound
+}
+
+// OpenStream opens a new stream to the remote peer. The remote
+// side gets hold of it with AcceptStream(id)
+func (p *TCPPeer) OpenStream () (Stream, error) {
+	return p.mux.open()
+}
+
+// AcceptStream returns the stream with the given id that was
+// opened by the remote peer
+func (p *TCPPeer) AcceptStream (id uint32) (Stream, error) {
+	return p.mux.accept(id)
+}
+
+// Send function writes bytes to the connection as a single
+// message frame for the other peer to read. It returns once the
+// frame is written, with the error of the write.
 func (t *TCPPeer) Send (b []byte) error {
-	_, err := t.Conn.Write(b)
-	return err
+	return t.mux.sendFrame(Frame{Type: IncomingMessage, Payload: b})
+}
+
+func (p *TCPPeer) rawConn () net.Conn {
+	return p.conn
 }
 
 type TCPTransportOpts struct {
+	PeerOpts
 	ListenAddr string
-	HandshakeFunc HandshakeFunc
-	Decoder Decoder
-	OnPeer func(Peer) error
+	// TLSConfig wraps every connection in TLS when it is set,
+	// see NewTLSConfig and NewMutualTLSConfig
+	TLSConfig *tls.Config
+	// TLSHandshakeTimeout bounds the TLS handshake of every
+	// connection, 5s by default like the handshake of the nodes
+	TLSHandshakeTimeout time.Duration
 }
 
 type TCPTransport struct {
 	TCPTransportOpts
+	baseTransport
 	listener net.Listener
-	rpcch chan RPC
 }
 
 func NewTCPTransport (opts TCPTransportOpts) *TCPTransport {
-	return &TCPTransport {
+	if opts.HeartbeatInterval == 0 {
+		opts.HeartbeatInterval = defaultHeartbeatInterval
+	}
+	if opts.TLSHandshakeTimeout == 0 {
+		opts.TLSHandshakeTimeout = defaultHandshakeTimeout
+	}
+	t := &TCPTransport {
 		TCPTransportOpts: opts,
-		rpcch: make(chan RPC, 1024),
 	}
+	t.init(&t.PeerOpts)
+	return t
 }
 
 func (t *TCPTransport) Addr() string {
 	return t.ListenAddr
 }
 
-// Consume returns a read-only channel for reading incoming
-// messages from another peer in the network
-func (t *TCPTransport) Consume() <- chan RPC {
-	return t.rpcch
-}
-
 // Close implements the Transport interface
 func (t *TCPTransport) Close() error {
+	if t.listener == nil {
+		return nil
+	}
 	return t.listener.Close()
 }
 
+// Shutdown implements the Transport interface
+func (t *TCPTransport) Shutdown (ctx context.Context) error {
+	return t.shutdown(ctx, t.Close)
+}
+
 // Dial implements the Transport interface
 func (t *TCPTransport) Dial(addr string) error {
-	conn, err := net.Dial("tcp", addr)
+	var (
+		conn net.Conn
+		err error
+	)
+	if t.TLSConfig != nil {
+		dialer := &net.Dialer{Timeout: t.TLSHandshakeTimeout}
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, t.TLSConfig)
+	} else {
+		conn, err = net.Dial("tcp", addr)
+	}
 	if err != nil {
 		return err
 	}
+	if !t.conns.track(conn) {
+		conn.Close()
+		return ErrTransportClosed
+	}
 	go t.handleConn(conn, true)
 	return nil
 }
@@ -89,12 +176,20 @@ func (t *TCPTransport) ListenAndAccept() error {
 	if err != nil {
 		return err
 	}
+	if t.TLSConfig != nil {
+		t.listener = tls.NewListener(t.listener, t.TLSConfig)
+	}
+	if !t.conns.goroutine() {
+		t.listener.Close()
+		return ErrTransportClosed
+	}
 	go t.startAcceptLoop()
 	log.Printf("TCP transport listening on port: %s\n", t.ListenAddr)
 	return nil
 }
 
 func (t *TCPTransport) startAcceptLoop() {
+	defer t.conns.wg.Done()
 	for {
 		conn, err := t.listener.Accept()
 		if errors.Is(err, net.ErrClosed) {
@@ -102,44 +197,30 @@ func (t *TCPTransport) startAcceptLoop() {
 		}
 		if err != nil {
 			fmt.Println("TCP Accept error", err)
+			continue
+		}
+		if !t.conns.track(conn) {
+			conn.Close()
+			return
 		}
 		go t.handleConn(conn, false)
 	}
 }
 
 func (t *TCPTransport) handleConn (conn net.Conn, outbound bool) {
-	var err error
-	defer func() {
-		fmt.Printf("Dropping peer connection: %s\n", err)
-		conn.Close()
-	}()
-	peer := NewTCPPeer(conn, outbound)
-	if err = t.HandshakeFunc(peer); err != nil {
-		conn.Close()
-		fmt.Printf("TCP handshake error: %s\n", err)
-		return
-	}
-	if t.OnPeer != nil {
-		if err = t.OnPeer(peer); err != nil {
-			return
-		}
-	}
-	// Read loop
-	for {
-		rpc := RPC{}
-		err = t.Decoder.Decode(conn, &rpc)
+	defer t.conns.untrack(conn)
+	// Complete the TLS handshake before anything else, so a node
+	// without a trusted certificate never becomes a peer. A node
+	// that never finishes it does not hold the connection forever.
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), t.TLSHandshakeTimeout)
+		err := tlsConn.HandshakeContext(ctx)
+		cancel()
 		if err != nil {
+			fmt.Printf("TLS handshake error: %s\n", err)
+			conn.Close()
 			return
 		}
-		rpc.From = conn.RemoteAddr().String()
-		if rpc.Stream {
-			peer.wg.Add(1)
-			fmt.Printf("[%s] incoming stream, waiting...\n", rpc.From)
-			peer.wg.Wait()
-			fmt.Printf("[%s] stream closed, resuming read loop\n", rpc.From)
-			continue
-		}
-		
-		t.rpcch <- rpc
 	}
-}
\ No newline at end of file
+	t.serve(conn, outbound, t.ListenAddr)
+}
@@ -1,7 +1,9 @@
 package p2p
 
 import (
+	"context"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -9,8 +11,10 @@ import (
 func TestTCPTransport (t *testing.T) {
 	opts := TCPTransportOpts {
 		ListenAddr: ":3000",
-		HandshakeFunc: NOPHandshakeFunc,
-		Decoder: DefaultDecoder{},
+		PeerOpts: PeerOpts{
+			HandshakeFunc: NOPHandshakeFunc,
+			Decoder: DefaultDecoder{},
+		},
 	}
 	
 	listenAddr := ":3000"
@@ -19,4 +23,25 @@ func TestTCPTransport (t *testing.T) {
 	assert.Equal(t, tr.ListenAddr, listenAddr)
 
 	assert.Nil(t, tr.ListenAndAccept())
-}
\ No newline at end of file
+	assert.Nil(t, tr.Shutdown(context.Background()))
+}
+
+func TestTCPTransportShutdown (t *testing.T) {
+	peers, gone := make(chan Peer, 2), make(chan Peer, 2)
+	tr1 := newHeartbeatTransport(t, peers, gone)
+	tr2 := newHeartbeatTransport(t, peers, gone)
+	assert.Nil(t, tr2.Dial(tr1.listener.Addr().String()))
+	<- peers
+	<- peers
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Nil(t, tr1.Shutdown(ctx))
+
+	// both ends of the connection are gone, and the transport
+	// does not take new connections
+	<- gone
+	<- gone
+	assert.ErrorIs(t, tr1.Dial(tr2.listener.Addr().String()), ErrTransportClosed)
+	assert.NotNil(t, tr2.Dial(tr1.listener.Addr().String()))
+}
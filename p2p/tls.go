@@ -0,0 +1,166 @@
+package p2p
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+)
+
+// ClusterCA is a self-signed certificate authority for the nodes
+// of a local cluster. It is meant for development clusters and
+// tests, production clusters should bring their own certificates.
+type ClusterCA struct {
+	Cert *x509.Certificate
+	key *ecdsa.PrivateKey
+}
+
+func NewClusterCA (name string) (*ClusterCA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{CommonName: name},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().AddDate(10, 0, 0),
+		IsCA: true,
+		BasicConstraintsValid: true,
+		KeyUsage: x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &ClusterCA{Cert: cert, key: key}, nil
+}
+
+// NewNodeCertificate issues a certificate for a node, usable both
+// for accepting and for dialing connections. hosts are added as
+// DNS or IP subject alternative names, localhost is always included.
+func (ca *ClusterCA) NewNodeCertificate (name string, hosts ...string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{CommonName: name},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().AddDate(1, 0, 0),
+		KeyUsage: x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames: []string{"localhost"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.Cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der, ca.Cert.Raw},
+		PrivateKey: key,
+		Leaf: leaf,
+	}, nil
+}
+
+// CertPool returns a pool that only trusts the CA
+func (ca *ClusterCA) CertPool () *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Cert)
+	return pool
+}
+
+// CertPEM returns the PEM encoded certificate of the CA, for
+// distributing it to nodes that run in other processes
+func (ca *ClusterCA) CertPEM () []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Cert.Raw})
+}
+
+// NewTLSConfig returns a config that encrypts the connections and
+// makes the dialing side verify that the certificate of the remote
+// node is signed by one of roots.
+//
+// Nodes are usually dialed by address (":3000") rather than host
+// name, so the chain is verified against roots without matching
+// the host name of the certificate.
+func NewTLSConfig (cert tls.Certificate, roots *x509.CertPool) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion: tls.VersionTLS12,
+		InsecureSkipVerify: true,
+		VerifyConnection: func (cs tls.ConnectionState) error {
+			// without client authentication the accepting
+			// side does not receive any certificate
+			if len(cs.PeerCertificates) == 0 {
+				return nil
+			}
+			return verifyChain(cs.PeerCertificates, roots)
+		},
+	}
+}
+
+// NewMutualTLSConfig is like NewTLSConfig, but additionally only
+// accepts connections from nodes presenting a certificate signed
+// by the cluster CA (mTLS)
+func NewMutualTLSConfig (cert tls.Certificate, ca *x509.CertPool) *tls.Config {
+	cfg := NewTLSConfig(cert, ca)
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	cfg.ClientCAs = ca
+	return cfg
+}
+
+func verifyChain (certs []*x509.Certificate, roots *x509.CertPool) error {
+	if len(certs) == 0 {
+		return errors.New("remote node did not present a certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots: roots,
+		Intermediates: intermediates,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return fmt.Errorf("certificate of remote node is not trusted: %w", err)
+	}
+	return nil
+}
+
+func newSerialNumber () (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
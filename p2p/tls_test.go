@@ -0,0 +1,89 @@
+package p2p
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// tlsHandshake runs a TLS handshake between a dialing and an
+// accepting node over an in-memory connection
+func tlsHandshake (dialCfg, acceptCfg *tls.Config) (dialErr, acceptErr error) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	errch := make(chan error, 1)
+	go func () {
+		server := tls.Server(c2, acceptCfg)
+		err := server.Handshake()
+		if err != nil {
+			c2.Close()
+		}
+		errch <- err
+	}()
+	client := tls.Client(c1, dialCfg)
+	dialErr = client.Handshake()
+	if dialErr != nil {
+		c1.Close()
+	}
+	acceptErr = <- errch
+	return dialErr, acceptErr
+}
+
+func TestMutualTLS (t *testing.T) {
+	ca, err := NewClusterCA("test-cluster")
+	assert.Nil(t, err)
+	other, err := NewClusterCA("other-cluster")
+	assert.Nil(t, err)
+
+	newCfg := func (ca *ClusterCA, name string) *tls.Config {
+		cert, err := ca.NewNodeCertificate(name)
+		assert.Nil(t, err)
+		return NewMutualTLSConfig(cert, ca.CertPool())
+	}
+	node1 := newCfg(ca, "node-1")
+	node2 := newCfg(ca, "node-2")
+	intruder := newCfg(other, "intruder")
+
+	dialErr, acceptErr := tlsHandshake(node1, node2)
+	assert.Nil(t, dialErr)
+	assert.Nil(t, acceptErr)
+
+	// a certificate from another CA is rejected on both sides
+	_, acceptErr = tlsHandshake(intruder, node2)
+	assert.NotNil(t, acceptErr)
+	dialErr, _ = tlsHandshake(node1, intruder)
+	assert.NotNil(t, dialErr)
+}
+
+func TestTLSHandshakeTimeout (t *testing.T) {
+	ca, err := NewClusterCA("test-cluster")
+	assert.Nil(t, err)
+	cert, err := ca.NewNodeCertificate("node-1")
+	assert.Nil(t, err)
+	tr := NewTCPTransport(TCPTransportOpts{
+		ListenAddr: "127.0.0.1:0",
+		TLSConfig: NewMutualTLSConfig(cert, ca.CertPool()),
+		TLSHandshakeTimeout: time.Millisecond * 100,
+		PeerOpts: PeerOpts{
+			HandshakeFunc: NOPHandshakeFunc,
+			Decoder: DefaultDecoder{},
+		},
+	})
+	assert.Nil(t, tr.ListenAndAccept())
+	defer tr.Close()
+
+	// a node that never starts the TLS handshake is disconnected
+	conn, err := net.Dial("tcp", tr.listener.Addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+	_, err = conn.Read(make([]byte, 1))
+	var netErr net.Error
+	assert.False(t, errors.As(err, &netErr) && netErr.Timeout(), "connection not closed: %v", err)
+}
@@ -1,14 +1,37 @@
 package p2p
 
 import (
+	"context"
 	"net"
+	"time"
 )
 
 // Peer is an interface that represents remote node
 type Peer interface {
-	net.Conn
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+	// Close closes the connection with the remote node
+	Close() error
+	// ID is the identity of the remote node verified during the
+	// handshake, or its remote address if the handshake does not
+	// verify identities
+	ID() string
+	// Outbound is true if we dialed the connection
+	Outbound() bool
+	// RTT is the round trip time measured by the last heartbeat
+	RTT() time.Duration
+	// Info is what has been negotiated with the remote node
+	// during the handshake
+	Info() PeerInfo
+	// CompressionStats count the stream data sent to the peer
+	CompressionStats() CompressionStats
+	// Send writes a message for the remote node and returns once it
+	// is written to the connection, or failed to be
 	Send ([]byte) error
-	CloseStream()
+	OpenStream() (Stream, error)
+	// AcceptStream hands out a stream opened by the remote node. A
+	// stream that is not accepted within 30 seconds is reset.
+	AcceptStream(uint32) (Stream, error)
 }
 
 // Transport is anything that handles communication
@@ -18,5 +41,9 @@ type Transport interface {
 	Dial(string) error
 	ListenAndAccept() error
 	Consume() <- chan RPC
+	// Close stops accepting connections
 	Close() error
+	// Shutdown closes every connection and waits until all the
+	// goroutines of the transport have exited or ctx is done
+	Shutdown(context.Context) error
 }
\ No newline at end of file
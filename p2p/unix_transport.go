@@ -0,0 +1,179 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"sync/atomic"
+)
+
+var ErrPeerNotAllowed = errors.New("peer credentials not allowed")
+
+type UnixTransportOpts struct {
+	PeerOpts
+	// ListenAddr is the path of the socket file
+	ListenAddr string
+	// AllowedUIDs are the users whose processes may connect, checked
+	// with the credentials of the connecting process. Any local user
+	// may connect when it is empty.
+	AllowedUIDs []uint32
+}
+
+// UnixTransport is a Transport over Unix domain sockets, for nodes
+// running on the same host
+type UnixTransport struct {
+	UnixTransportOpts
+	baseTransport
+	listener *net.UnixListener
+	// lock is held while the transport listens, see lockSocket
+	lock *os.File
+	nextConn atomic.Uint64
+}
+
+func NewUnixTransport (opts UnixTransportOpts) *UnixTransport {
+	t := &UnixTransport{
+		UnixTransportOpts: opts,
+	}
+	t.init(&t.PeerOpts)
+	return t
+}
+
+func (t *UnixTransport) Addr () string {
+	return t.ListenAddr
+}
+
+// Close stops accepting connections and removes the socket file
+func (t *UnixTransport) Close () error {
+	if t.listener == nil {
+		return nil
+	}
+	err := t.listener.Close()
+	if t.lock != nil {
+		t.lock.Close()
+		t.lock = nil
+	}
+	return err
+}
+
+// Shutdown implements the Transport interface
+func (t *UnixTransport) Shutdown (ctx context.Context) error {
+	return t.shutdown(ctx, t.Close)
+}
+
+// Dial implements the Transport interface
+func (t *UnixTransport) Dial (addr string) error {
+	conn, err := net.Dial("unix", addr)
+	if err != nil {
+		return err
+	}
+	if !t.conns.track(conn) {
+		conn.Close()
+		return ErrTransportClosed
+	}
+	go t.handleConn(conn, true)
+	return nil
+}
+
+// ListenAndAccept removes the socket file left behind by a node that
+// did not shut down cleanly, unless another node still listens on it
+func (t *UnixTransport) ListenAndAccept () error {
+	lock, err := lockSocket(t.ListenAddr)
+	if err != nil {
+		return err
+	}
+	if lock != nil {
+		if err := removeStaleSocket(t.ListenAddr); err != nil {
+			lock.Close()
+			return err
+		}
+	}
+	addr := &net.UnixAddr{Name: t.ListenAddr, Net: "unix"}
+	t.listener, err = net.ListenUnix("unix", addr)
+	if err != nil {
+		if lock != nil {
+			lock.Close()
+		}
+		return err
+	}
+	t.lock = lock
+	if !t.conns.goroutine() {
+		t.Close()
+		return ErrTransportClosed
+	}
+	go t.startAcceptLoop()
+	log.Printf("Unix transport listening on socket: %s\n", t.ListenAddr)
+	return nil
+}
+
+func (t *UnixTransport) startAcceptLoop () {
+	defer t.conns.wg.Done()
+	for {
+		conn, err := t.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			fmt.Println("Unix Accept error", err)
+			continue
+		}
+		if err := t.checkCredentials(conn); err != nil {
+			fmt.Printf("rejecting connection on %s: %s\n", t.ListenAddr, err)
+			conn.Close()
+			continue
+		}
+		if !t.conns.track(conn) {
+			conn.Close()
+			return
+		}
+		go t.handleConn(conn, false)
+	}
+}
+
+func (t *UnixTransport) checkCredentials (conn net.Conn) error {
+	if len(t.AllowedUIDs) == 0 {
+		return nil
+	}
+	uid, err := peerUID(conn.(*net.UnixConn))
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(t.AllowedUIDs, uid) {
+		return fmt.Errorf("%w: uid %d", ErrPeerNotAllowed, uid)
+	}
+	return nil
+}
+
+func (t *UnixTransport) handleConn (conn net.Conn, outbound bool) {
+	defer t.conns.untrack(conn)
+	// the client side of a Unix socket is usually unnamed, name
+	// every connection after the socket so peers can be told apart
+	name := fmt.Sprintf("%s#%d", t.ListenAddr, t.nextConn.Add(1))
+	if outbound {
+		conn = &namedConn{Conn: conn, local: &net.UnixAddr{Name: name, Net: "unix"}, remote: conn.RemoteAddr()}
+	} else {
+		conn = &namedConn{Conn: conn, local: conn.LocalAddr(), remote: &net.UnixAddr{Name: name, Net: "unix"}}
+	}
+	t.serve(conn, outbound, t.ListenAddr)
+}
+
+// removeStaleSocket removes the socket file at path. It must only be
+// called with the lock of the socket held, which makes sure that no
+// other node listens on it.
+func removeStaleSocket (path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode() & os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	log.Printf("removing stale socket %s\n", path)
+	return os.Remove(path)
+}
@@ -0,0 +1,88 @@
+package p2p
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newUnixTransport (t *testing.T, path string, peers chan Peer, allowed ...uint32) *UnixTransport {
+	tr := NewUnixTransport(UnixTransportOpts{
+		ListenAddr: path,
+		PeerOpts: PeerOpts{
+			HandshakeFunc: NOPHandshakeFunc,
+			Decoder: DefaultDecoder{},
+			OnPeer: func (p Peer) error { peers <- p; return nil },
+		},
+		AllowedUIDs: allowed,
+	})
+	assert.Nil(t, tr.ListenAndAccept())
+	t.Cleanup(func () { tr.Close() })
+	return tr
+}
+
+func TestUnixTransport (t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "node1.sock")
+
+	// a socket file left behind by a crashed node
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	assert.Nil(t, err)
+	l.SetUnlinkOnClose(false)
+	l.Close()
+
+	peers := make(chan Peer, 2)
+	tr1 := newUnixTransport(t, path, peers)
+	tr2 := newUnixTransport(t, filepath.Join(dir, "node2.sock"), peers)
+
+	// the socket is in use now
+	assert.ErrorIs(t, NewUnixTransport(UnixTransportOpts{ListenAddr: path}).ListenAndAccept(), ErrAddrInUse)
+
+	assert.Nil(t, tr2.Dial(path))
+	p1, p2 := <- peers, <- peers
+	assert.NotEqual(t, p1.ID(), p2.ID())
+	if p1.Outbound() {
+		p1 = p2
+	}
+	go p1.Send([]byte("hello"))
+	rpc := <- tr2.Consume()
+	assert.Equal(t, []byte("hello"), rpc.Payload)
+
+	tr1.Close()
+	_, err = os.Stat(path)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestUnixTransportPeerCredentials (t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only checked on Linux")
+	}
+	dir := t.TempDir()
+	uid := uint32(os.Getuid())
+	peers := make(chan Peer, 2)
+	allowed := newUnixTransport(t, filepath.Join(dir, "allowed.sock"), peers, uid)
+	denied := newUnixTransport(t, filepath.Join(dir, "denied.sock"), peers, uid + 1)
+
+	// the connection is accepted by the kernel, but closed right
+	// away by the transport
+	dialer := newUnixTransport(t, filepath.Join(dir, "dialer.sock"), make(chan Peer, 2))
+	assert.Nil(t, dialer.Dial(denied.ListenAddr))
+	select {
+	case <- peers:
+		t.Fatal("connection from a user that is not allowed")
+	case <- time.After(time.Millisecond * 100):
+	}
+
+	assert.Nil(t, dialer.Dial(allowed.ListenAddr))
+	select {
+	case p := <- peers:
+		assert.False(t, p.Outbound())
+	case <- time.After(time.Second):
+		t.Fatal("connection from an allowed user was rejected")
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/priyangshupal/distributed-file-system/p2p"
+)
+
+// peerRegistry is the set of connected peers, keyed by node ID. It
+// hands out snapshots, so the callers never hold its lock while
+// talking to the peers.
+type peerRegistry struct {
+	mu sync.RWMutex
+	peers map[string]p2p.Peer
+	// added is closed and replaced whenever a peer is added
+	added chan struct{}
+}
+
+func newPeerRegistry () *peerRegistry {
+	return &peerRegistry{peers: make(map[string]p2p.Peer), added: make(chan struct{})}
+}
+
+func (r *peerRegistry) get (id string) (p2p.Peer, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	p, ok := r.peers[id]
+	return p, ok
+}
+
+func (r *peerRegistry) len () int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.peers)
+}
+
+// snapshot returns a copy of the peers, by node ID
+func (r *peerRegistry) snapshot () map[string]p2p.Peer {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	peers := make(map[string]p2p.Peer, len(r.peers))
+	for id, p := range r.peers {
+		peers[id] = p
+	}
+	return peers
+}
+
+// add registers p. If a peer with the same ID is registered already,
+// it is only replaced if replace returns true for it. The replaced
+// peer is returned, so the caller can close it.
+func (r *peerRegistry) add (p p2p.Peer, replace func (old p2p.Peer) bool) (p2p.Peer, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old, ok := r.peers[p.ID()]
+	if ok && !replace(old) {
+		return old, false
+	}
+	r.peers[p.ID()] = p
+	close(r.added)
+	r.added = make(chan struct{})
+	return old, true
+}
+
+// wait returns the peer with the ID once it is registered
+func (r *peerRegistry) wait (ctx context.Context, id string) (p2p.Peer, error) {
+	for {
+		r.mu.RLock()
+		p, ok := r.peers[id]
+		added := r.added
+		r.mu.RUnlock()
+		if ok {
+			return p, nil
+		}
+		select {
+		case <- added:
+		case <- ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// remove unregisters p, unless it has been replaced by another
+// connection to the same node already
+func (r *peerRegistry) remove (p p2p.Peer) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.peers[p.ID()] != p {
+		return false
+	}
+	delete(r.peers, p.ID())
+	return true
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/priyangshupal/distributed-file-system/p2p"
+)
+
+const (
+	defaultPexInterval = time.Second * 30
+	defaultTargetPeers = 8
+)
+
+// PeerRecord is a node a peer is connected with
+type PeerRecord struct {
+	ID string
+	// Addr is the address the node accepts connections on
+	Addr string
+}
+
+// MessagePeerExchange is sent to every peer when it connects and
+// every PexInterval after that, so nodes learn about the rest of
+// the cluster from a single bootstrap node
+type MessagePeerExchange struct {
+	Peers []PeerRecord
+}
+
+// knownPeers returns the nodes we are connected with and that
+// can be dialed by others
+func (s *FileServer) knownPeers () []PeerRecord {
+	peers := s.peers.snapshot()
+	records := make([]PeerRecord, 0, len(peers))
+	for id, peer := range peers {
+		if addr := peer.Info().ListenAddr; len(addr) > 0 {
+			records = append(records, PeerRecord{ID: id, Addr: addr})
+		}
+	}
+	return records
+}
+
+func (s *FileServer) sendPeerExchange (peer p2p.Peer) error {
+	msg := Message{
+		Payload: MessagePeerExchange{Peers: s.knownPeers()},
+	}
+	return s.send(peer, &msg)
+}
+
+// pexLoop periodically shares the known peers with every peer
+func (s *FileServer) pexLoop () {
+	defer s.routines.Done()
+	ticker := time.NewTicker(s.PexInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <- ticker.C:
+		case <- s.quitch:
+			return
+		}
+		for _, peer := range s.peers.snapshot() {
+			if err := s.sendPeerExchange(peer); err != nil {
+				log.Printf("[%s] peer exchange with %s failed: %v", s.Transport.Addr(), peer.ID(), err)
+			}
+		}
+	}
+}
+
+// handleMessagePeerExchange dials the nodes we are not connected
+// with yet, until we are connected with or dialing TargetPeers nodes
+func (s *FileServer) handleMessagePeerExchange (from string, msg MessagePeerExchange) error {
+	peers := s.peers.len() + s.dialing()
+	for _, rec := range msg.Peers {
+		if rec.ID == s.ID || len(rec.Addr) == 0 {
+			continue
+		}
+		if _, connected := s.peers.get(rec.ID); connected {
+			continue
+		}
+		if peers >= s.TargetPeers {
+			return nil
+		}
+		log.Printf("[%s] learned about %s (%s) from %s", s.Transport.Addr(), rec.Addr, rec.ID, from)
+		if s.connMgr.Add(rec.Addr) {
+			peers++
+		}
+	}
+	return nil
+}
+
+// dialing returns the number of nodes the connection manager is
+// about to dial or dialing right now. The nodes backing off after a
+// failed dial are not counted, they may never come back.
+func (s *FileServer) dialing () int {
+	n := 0
+	for _, st := range s.connMgr.States() {
+		if st.State == p2p.StateDisconnected || st.State == p2p.StateConnecting {
+			n++
+		}
+	}
+	return n
+}
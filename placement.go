@@ -0,0 +1,44 @@
+package main
+
+import (
+	"slices"
+
+	"github.com/priyangshupal/distributed-file-system/crypto"
+	"github.com/priyangshupal/distributed-file-system/p2p"
+)
+
+// defaultReplicationFactor is the number of nodes holding a
+// file, including the node that stored it if it is one of them
+const defaultReplicationFactor = 3
+
+// placementKey is the position of a file on the ring. Files are
+// namespaced by the ID of the node that stored them, so the ID is
+// part of the key.
+func placementKey (id string, key string) string {
+	return id + "/" + crypto.HashKey(key)
+}
+
+// replicas splits the peers into the ones responsible for the file
+// of the node id and all the others. The local node is never part
+// of either, but it counts as one of the replicas when the ring
+// puts the file on it.
+func (s *FileServer) replicas (id string, key string, peers map[string]p2p.Peer) (map[string]p2p.Peer, map[string]p2p.Peer) {
+	replicas := make(map[string]p2p.Peer)
+	others := make(map[string]p2p.Peer, len(peers))
+	for pid, peer := range peers {
+		others[pid] = peer
+	}
+	for _, node := range s.ring.Lookup(placementKey(id, key), s.ReplicationFactor) {
+		if peer, ok := others[node]; ok {
+			replicas[node] = peer
+			delete(others, node)
+		}
+	}
+	return replicas, others
+}
+
+// isReplica reports whether the local node is responsible for the
+// file of the node id
+func (s *FileServer) isReplica (id string, key string) bool {
+	return slices.Contains(s.ring.Lookup(placementKey(id, key), s.ReplicationFactor), s.ID)
+}
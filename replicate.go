@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/priyangshupal/distributed-file-system/p2p"
+)
+
+const (
+	defaultStoreRetries = 2
+	storeRetryBackoff = time.Millisecond * 100
+	// transferChunk is how much of a file is written on the stream
+	// at once, every chunk written counts as progress
+	transferChunk = 64 * 1024
+)
+
+var ErrWriteConsistency = errors.New("not enough replicas confirmed the write")
+
+// Consistency is the number of replicas that have to answer a read
+// or confirm a write. For writes the local copy counts when the local
+// node is one of the replicas.
+type Consistency int
+
+const (
+	// ConsistencyOne waits for a single replica
+	ConsistencyOne Consistency = iota + 1
+	// ConsistencyQuorum waits for a majority of the replicas
+	ConsistencyQuorum
+	// ConsistencyAll waits for every replica
+	ConsistencyAll
+)
+
+func (c Consistency) String () string {
+	switch c {
+	case ConsistencyAll:
+		return "all"
+	case ConsistencyQuorum:
+		return "quorum"
+	case ConsistencyOne:
+		return "one"
+	}
+	return "unknown"
+}
+
+// required returns the number of the replicas that have to confirm
+func (c Consistency) required (replicas int) int {
+	switch c {
+	case ConsistencyQuorum:
+		return replicas / 2 + 1
+	case ConsistencyOne:
+		return min(replicas, 1)
+	}
+	return replicas
+}
+
+// ReplicaError reports the replicas that failed to store a file
+type ReplicaError struct {
+	Errs map[string]error
+}
+
+func (e *ReplicaError) Error () string {
+	return "storing failed on " + joinPeerErrs("replica", e.Errs)
+}
+
+func (e *ReplicaError) Unwrap () []error {
+	return peerErrs(e.Errs)
+}
+
+type replicaResult struct {
+	id string
+	err error
+}
+
+// replicate sends the encrypted file and its version to the peers
+// and waits until `need` of them confirmed that it is on their disk.
+// The transfers to the other peers go on in the background after
+// that, only ctx being done before stops them.
+func (s *FileServer) replicate (ctx context.Context, hashedKey string, version int64, data []byte, peers map[string]p2p.Peer, need int) error {
+	if len(peers) == 0 && need == 0 {
+		return nil
+	}
+	tctx, tdone, err := s.beginOp(context.Background())
+	if err != nil {
+		return err
+	}
+	tctx, cancel := context.WithCancel(tctx)
+
+	digest := sha256.Sum256(data)
+	results := make(chan replicaResult, len(peers))
+	var wg sync.WaitGroup
+	for id := range peers {
+		wg.Add(1)
+		go func (id string) {
+			defer wg.Done()
+			results <- replicaResult{id: id, err: s.storeOnPeer(tctx, id, hashedKey, version, data, digest[:])}
+		}(id)
+	}
+	go func () {
+		wg.Wait()
+		cancel()
+		tdone()
+	}()
+
+	acked := 0
+	failed := make(map[string]error)
+	for acked < need {
+		if len(peers) - len(failed) < need {
+			return fmt.Errorf("%w: %d of %d replicas confirmed: %w", ErrWriteConsistency, acked, need, &ReplicaError{Errs: failed})
+		}
+		select {
+		case r := <- results:
+			if r.err != nil {
+				failed[r.id] = r.err
+				continue
+			}
+			acked++
+		case <- ctx.Done():
+			cancel()
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// storeOnPeer sends the file to the node and waits for its ack,
+// trying again after a backoff up to StoreRetries times
+func (s *FileServer) storeOnPeer (ctx context.Context, id string, hashedKey string, version int64, data []byte, digest []byte) error {
+	var err error
+	for attempt := 0; attempt <= max(s.StoreRetries, 0); attempt++ {
+		if attempt > 0 {
+			log.Printf("[%s] storing file (%s) on %s failed, retrying: %v", s.Transport.Addr(), hashedKey, id, err)
+			select {
+			case <- time.After(storeRetryBackoff << (attempt - 1)):
+			case <- ctx.Done():
+				return err
+			}
+		}
+		if err = s.sendFile(ctx, id, hashedKey, version, data, digest); err == nil || ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// sendFile writes the file on a new stream to the node and checks
+// the size and the digest it acknowledges
+func (s *FileServer) sendFile (ctx context.Context, id string, hashedKey string, version int64, data []byte, digest []byte) error {
+	// the peer may have reconnected since the last attempt
+	peer, ok := s.peers.get(id)
+	if !ok {
+		return fmt.Errorf("not connected with %s", id)
+	}
+	st, err := peer.OpenStream()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+	defer closeOnDone(ctx, st)()
+
+	// the request is registered before the transfer, so an early
+	// answer is not lost, but the time the replica has to answer
+	// only starts once the whole file is written
+	req := s.newRequest(ctx, 1)
+	defer s.finishRequest(req)
+	msg := Message {
+		RequestID: req.id,
+		Payload: MessageStoreFile {
+			ID: s.ID,
+			Key: hashedKey,
+			Size: int64(len(data)),
+			StreamID: st.ID(),
+			Version: version,
+		},
+	}
+	if err := s.send(peer, &msg); err != nil {
+		return err
+	}
+	if err := writeWithProgress(st, data, s.RequestTimeout); err != nil {
+		return err
+	}
+	req.deadline = s.requestDeadline(ctx)
+
+	responses, err := s.awaitResponses(ctx, req, []string{id})
+	if err != nil {
+		return err
+	}
+	if err := responseErr(responses[id]); err != nil {
+		return err
+	}
+	ack, ok := responses[id].(MessageStoreFileResponse)
+	if !ok {
+		return fmt.Errorf("unexpected response %T to the store of file (%s)", responses[id], hashedKey)
+	}
+	if ack.Size != int64(len(data)) || !bytes.Equal(ack.Digest, digest) {
+		return fmt.Errorf("stored (%d) bytes with digest %x, expected (%d) bytes with digest %x", ack.Size, ack.Digest, len(data), digest)
+	}
+	return nil
+}
+
+// writeWithProgress writes data on the stream, but gives up once no
+// chunk could be written for idle. A node that never accepts the
+// stream, e.g. because it did not get the message announcing it,
+// stops reading as soon as the flow control window is full.
+func writeWithProgress (st io.WriteCloser, data []byte, idle time.Duration) error {
+	var stalled atomic.Bool
+	timer := time.AfterFunc(idle, func () {
+		stalled.Store(true)
+		st.Close()
+	})
+	defer timer.Stop()
+	for len(data) > 0 {
+		n := min(len(data), transferChunk)
+		if _, err := st.Write(data[:n]); err != nil {
+			if stalled.Load() {
+				return fmt.Errorf("%w: no progress writing the file for %s", ErrRequestTimeout, idle)
+			}
+			return err
+		}
+		data = data[n:]
+		timer.Reset(idle)
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const defaultRequestTimeout = time.Second * 5
+
+var (
+	ErrRequestTimeout = errors.New("request timed out")
+	ErrServerStopped = errors.New("file server stopped")
+	ErrNotFound = errors.New("file not found")
+)
+
+// response is a reply received from a peer for a pending request
+type response struct {
+	from string
+	payload any
+}
+
+// pendingRequest is a request that has been sent to one or more
+// peers and is waiting for their responses. All the messages of a
+// request carry the same RequestID, so the responses can be routed
+// back to the caller waiting on respch.
+type pendingRequest struct {
+	id uint64
+	deadline time.Time
+	respch chan response
+}
+
+// newRequest registers a request that expects at most `peers`
+// responses and that expires after RequestTimeout, or earlier
+// if ctx has a closer deadline
+func (s *FileServer) newRequest (ctx context.Context, peers int) *pendingRequest {
+	req := &pendingRequest{
+		id: s.nextRequestID.Add(1),
+		deadline: s.requestDeadline(ctx),
+		respch: make(chan response, peers),
+	}
+	s.pendingLock.Lock()
+	defer s.pendingLock.Unlock()
+	s.pending[req.id] = req
+	return req
+}
+
+// requestDeadline is when a request sent now expires
+func (s *FileServer) requestDeadline (ctx context.Context) time.Time {
+	deadline := time.Now().Add(s.RequestTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	return deadline
+}
+
+// finishRequest unregisters the request. Responses arriving after
+// that are dropped.
+func (s *FileServer) finishRequest (req *pendingRequest) {
+	s.pendingLock.Lock()
+	defer s.pendingLock.Unlock()
+	delete(s.pending, req.id)
+}
+
+// awaitResponses waits until every peer in `from` has answered the
+// request, the deadline of the request has passed or ctx is done.
+// The responses received so far are returned in all cases.
+func (s *FileServer) awaitResponses (ctx context.Context, req *pendingRequest, from []string) (map[string]any, error) {
+	waiting := make(map[string]bool)
+	for _, addr := range from {
+		waiting[addr] = true
+	}
+	responses := make(map[string]any)
+	for len(waiting) > 0 {
+		resp, err := s.nextResponse(ctx, req, waiting)
+		if err != nil {
+			return responses, err
+		}
+		responses[resp.from] = resp.payload
+	}
+	return responses, nil
+}
+
+// nextResponse waits for the next response from one of the peers in
+// waiting and removes that peer from it
+func (s *FileServer) nextResponse (ctx context.Context, req *pendingRequest, waiting map[string]bool) (response, error) {
+	timer := time.NewTimer(time.Until(req.deadline))
+	defer timer.Stop()
+
+	for {
+		select {
+		case resp := <- req.respch:
+			if !waiting[resp.from] {
+				continue
+			}
+			delete(waiting, resp.from)
+			return resp, nil
+		case <- timer.C:
+			missing := make([]string, 0, len(waiting))
+			for addr := range waiting {
+				missing = append(missing, addr)
+			}
+			sort.Strings(missing)
+			return response{}, fmt.Errorf("%w: no response from [%s]", ErrRequestTimeout, strings.Join(missing, ", "))
+		case <- ctx.Done():
+			return response{}, ctx.Err()
+		case <- s.quitch:
+			return response{}, ErrServerStopped
+		}
+	}
+}
+
+// handleResponse routes a response back to the request waiting for it
+func (s *FileServer) handleResponse (from string, msg *Message) error {
+	s.pendingLock.Lock()
+	req, ok := s.pending[msg.RequestID]
+	s.pendingLock.Unlock()
+	if !ok {
+		return fmt.Errorf("[%s] dropping response from %s to unknown or expired request (%d)", s.Transport.Addr(), from, msg.RequestID)
+	}
+
+	select {
+	case req.respch <- response{from: from, payload: msg.Payload}:
+		return nil
+	default:
+		return fmt.Errorf("[%s] unexpected response from %s to request (%d)", s.Transport.Addr(), from, msg.RequestID)
+	}
+}
+
+// responseErr returns the error reported by the remote peer in
+// a response, if any
+func responseErr (payload any) error {
+	var errStr string
+	switch v := payload.(type) {
+	case MessageStoreFileResponse:
+		errStr = v.Err
+	case MessageGetFileResponse:
+		errStr = v.Err
+	case MessageDeleteFileResponse:
+		errStr = v.Err
+	case MessageFindNodeResponse:
+		errStr = v.Err
+	case MessageFindValueResponse:
+		errStr = v.Err
+	case MessageAddProviderResponse:
+		errStr = v.Err
+	default:
+		return fmt.Errorf("unexpected response type %T", payload)
+	}
+	if len(errStr) > 0 {
+		return errors.New(errStr)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package ring
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const DefaultVirtualNodes = 128
+
+// Ring places keys on nodes with consistent hashing. Every node is
+// hashed onto the ring at a number of virtual points, and a key
+// belongs to the first distinct nodes found walking clockwise from
+// the hash of the key. Adding or removing a node only moves the keys
+// next to its points, about 1/N of all the keys.
+type Ring struct {
+	virtualNodes int
+
+	mu sync.RWMutex
+	// points are sorted by hash
+	points []point
+	nodes map[string]bool
+}
+
+type point struct {
+	hash uint64
+	node string
+}
+
+// New returns an empty ring placing every node at virtualNodes
+// points, DefaultVirtualNodes if it is not positive
+func New (virtualNodes int) *Ring {
+	if virtualNodes <= 0 {
+		virtualNodes = DefaultVirtualNodes
+	}
+	return &Ring{
+		virtualNodes: virtualNodes,
+		nodes: make(map[string]bool),
+	}
+}
+
+func (r *Ring) Add (node string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.nodes[node] {
+		return
+	}
+	r.nodes[node] = true
+	for i := 0; i < r.virtualNodes; i++ {
+		r.points = append(r.points, point{hash: hash(node + "#" + strconv.Itoa(i)), node: node})
+	}
+	sort.Slice(r.points, func (i, j int) bool {
+		return r.points[i].hash < r.points[j].hash
+	})
+}
+
+func (r *Ring) Remove (node string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.nodes[node] {
+		return
+	}
+	delete(r.nodes, node)
+	points := r.points[:0]
+	for _, p := range r.points {
+		if p.node != node {
+			points = append(points, p)
+		}
+	}
+	r.points = points
+}
+
+// Nodes returns the nodes on the ring, sorted
+func (r *Ring) Nodes () []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	nodes := make([]string, 0, len(r.nodes))
+	for node := range r.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// Lookup returns the n nodes responsible for the key, in order of
+// preference. Fewer nodes are returned if the ring is smaller.
+func (r *Ring) Lookup (key string, n int) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	n = min(n, len(r.nodes))
+	if n <= 0 {
+		return nil
+	}
+	h := hash(key)
+	start := sort.Search(len(r.points), func (i int) bool {
+		return r.points[i].hash >= h
+	})
+	nodes := make([]string, 0, n)
+	seen := make(map[string]bool, n)
+	for i := 0; len(nodes) < n; i++ {
+		p := r.points[(start + i) % len(r.points)]
+		if !seen[p.node] {
+			seen[p.node] = true
+			nodes = append(nodes, p.node)
+		}
+	}
+	return nodes
+}
+
+func hash (s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
@@ -0,0 +1,58 @@
+package ring
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRingLookup (t *testing.T) {
+	r := New(0)
+	assert.Nil(t, r.Lookup("key", 3))
+
+	for i := 0; i < 5; i++ {
+		r.Add(fmt.Sprintf("node%d", i))
+	}
+	nodes := r.Lookup("key", 3)
+	assert.Len(t, nodes, 3)
+	assert.Len(t, map[string]bool{nodes[0]: true, nodes[1]: true, nodes[2]: true}, 3)
+	// the same key always maps to the same nodes
+	assert.Equal(t, nodes, r.Lookup("key", 3))
+	// asking for more nodes than the ring holds returns all of them
+	assert.Len(t, r.Lookup("key", 10), 5)
+
+	r.Remove(nodes[0])
+	assert.Equal(t, nodes[1:], r.Lookup("key", 2))
+	assert.Len(t, r.Nodes(), 4)
+}
+
+func TestRingBalance (t *testing.T) {
+	r := New(0)
+	for i := 0; i < 4; i++ {
+		r.Add(fmt.Sprintf("node%d", i))
+	}
+	keys := 10000
+	owners := make(map[string]int)
+	before := make([]string, keys)
+	for i := range before {
+		before[i] = r.Lookup(fmt.Sprintf("key%d", i), 1)[0]
+		owners[before[i]]++
+	}
+	for _, n := range owners {
+		assert.InDelta(t, keys / 4, n, float64(keys) / 10)
+	}
+
+	// a new node only takes keys, it never moves them between
+	// the old nodes
+	r.Add("node4")
+	moved := 0
+	for i, old := range before {
+		owner := r.Lookup(fmt.Sprintf("key%d", i), 1)[0]
+		if owner != old {
+			assert.Equal(t, "node4", owner)
+			moved++
+		}
+	}
+	assert.InDelta(t, keys / 5, moved, float64(keys) / 10)
+}
@@ -2,35 +2,111 @@ package main
 
 import (
 	"bytes"
-	"encoding/binary"
+	"context"
+	"crypto/ed25519"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/priyangshupal/distributed-file-system/crypto"
+	"github.com/priyangshupal/distributed-file-system/dht"
 	"github.com/priyangshupal/distributed-file-system/p2p"
+	"github.com/priyangshupal/distributed-file-system/ring"
 	"github.com/priyangshupal/distributed-file-system/store"
 )
 
 type FileServerOpts struct {
+	// ID is derived from IdentityKey, it is the ID the handshake
+	// proves to the peers. Setting a different one is an error.
 	ID string
+	// IdentityKey is the long-lived key of the node, the same key
+	// has to be given to the handshake of the transport
+	IdentityKey ed25519.PrivateKey
 	EncKey []byte
 	StorageRoot string
 	PathTransformFunc store.PathTransformFunc	
 	Transport p2p.Transport
 	BootstrapNodes []string
+	// RequestTimeout is how long a request waits for the
+	// responses of the peers before giving up
+	RequestTimeout time.Duration
+	// PexInterval is how often the known peers are shared
+	// with every peer, see MessagePeerExchange
+	PexInterval time.Duration
+	// TargetPeers is the number of nodes the server connects
+	// with at most through peer exchange
+	TargetPeers int
+	// Workers is the number of messages handled concurrently,
+	// 16 by default
+	Workers int
+	// WorkerQueueSize is the number of messages that may wait for a
+	// worker, 1024 by default. While it is full no more messages are
+	// consumed from the transport.
+	WorkerQueueSize int
+	// ReplicationFactor is the number of nodes a file is stored on,
+	// picked with consistent hashing. 3 by default.
+	ReplicationFactor int
+	// VirtualNodes is the number of points every node has on the
+	// hash ring, see ring.New
+	VirtualNodes int
+	// WriteConsistency is the number of replicas Store waits for,
+	// ConsistencyAll by default
+	WriteConsistency Consistency
+	// ReadConsistency is the number of replicas Get waits for before
+	// reading the file, ConsistencyOne by default
+	ReadConsistency Consistency
+	// StoreRetries is how often sending a file to a replica is tried
+	// again, 2 by default. Negative values disable retries.
+	StoreRetries int
 }
 
 type FileServer struct {
 	FileServerOpts
 
+	// peerLock serialises onPeer and onPeerDisconnect, so the
+	// connection manager learns about them in the same order
 	peerLock sync.Mutex
-	peers map[string]p2p.Peer
+	peers *peerRegistry
 	store *store.Store
 	quitch chan struct {}
+	connMgr *p2p.ConnManager
+	workers *workerPool
+	// ring holds the local node and the connected peers, it
+	// decides which of them are responsible for a file
+	ring *ring.Ring
+	// dht finds the nodes holding a file without asking every peer
+	dht *dht.DHT
+	// lookupConns are the connections dialed only for the DHT, by
+	// address, see connect
+	lookupLock sync.Mutex
+	lookupConns map[string]*lookupConn
+	tombstones *tombstoneStore
+
+	nextRequestID atomic.Uint64
+	// lastVersion is the version given to the last write or delete
+	// of a file owned by this node, see nextVersion
+	lastVersion atomic.Int64
+	pendingLock sync.Mutex
+	pending map[uint64]*pendingRequest
+
+	// opsLock guards stopping and the start of new operations,
+	// ops are the operations in flight, see beginOp
+	opsLock sync.Mutex
+	stopping bool
+	ops sync.WaitGroup
+	opsCtx context.Context
+	cancelOps context.CancelFunc
+	stopOnce sync.Once
+	// routines are the loops started by Start
+	routines sync.WaitGroup
 }
 
 func NewFileServer(opts FileServerOpts) *FileServer {
@@ -39,51 +115,213 @@ func NewFileServer(opts FileServerOpts) *FileServer {
 		PathTransformFunc: opts.PathTransformFunc,
 	}
 
-	if len(opts.ID) == 0 { opts.ID = crypto.GenerateID() }
-	
-	return &FileServer{
+	if opts.IdentityKey == nil {
+		key, err := crypto.NewIdentityKey()
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.IdentityKey = key
+	}
+	id := crypto.IDFromPublicKey(opts.IdentityKey.Public().(ed25519.PublicKey))
+	if len(opts.ID) > 0 && opts.ID != id {
+		log.Fatalf("node ID %s does not match the identity key (%s)", opts.ID, id)
+	}
+	opts.ID = id
+	if opts.RequestTimeout == 0 { opts.RequestTimeout = defaultRequestTimeout }
+	if opts.PexInterval == 0 { opts.PexInterval = defaultPexInterval }
+	if opts.TargetPeers == 0 { opts.TargetPeers = defaultTargetPeers }
+	if opts.Workers == 0 { opts.Workers = defaultWorkers }
+	if opts.WorkerQueueSize == 0 { opts.WorkerQueueSize = defaultWorkerQueueSize }
+	if opts.ReplicationFactor == 0 { opts.ReplicationFactor = defaultReplicationFactor }
+	if opts.StoreRetries == 0 { opts.StoreRetries = defaultStoreRetries }
+	if opts.WriteConsistency == 0 { opts.WriteConsistency = ConsistencyAll }
+	if opts.ReadConsistency == 0 { opts.ReadConsistency = ConsistencyOne }
+
+	st := store.NewStore(storeOpts)
+	tombstones, err := loadTombstones(filepath.Join(st.Root, tombstonesFile))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	quitch := make(chan struct{})
+	opsCtx, cancelOps := context.WithCancel(context.Background())
+	r := ring.New(opts.VirtualNodes)
+	r.Add(opts.ID)
+	s := &FileServer{
 		FileServerOpts: opts,
-		store: store.NewStore(storeOpts),
-		quitch: make(chan struct{}),
-		peers: make(map[string]p2p.Peer),
+		store: st,
+		tombstones: tombstones,
+		quitch: quitch,
+		workers: newWorkerPool(opts.Workers, opts.WorkerQueueSize, quitch),
+		connMgr: p2p.NewConnManager(p2p.ConnManagerOpts{Transport: opts.Transport}),
+		peers: newPeerRegistry(),
+		ring: r,
+		lookupConns: make(map[string]*lookupConn),
+		pending: make(map[uint64]*pendingRequest),
+		opsCtx: opsCtx,
+		cancelOps: cancelOps,
+	}
+	s.dht = dht.New(dht.Opts{
+		Self: dht.Contact{ID: nodeID(opts.ID), Addr: opts.Transport.Addr()},
+		Network: dhtNetwork{s: s},
+	})
+	return s
+}
+
+// BroadcastError reports the peers a broadcast could not be sent to
+type BroadcastError struct {
+	Errs map[string]error
+}
+
+func (e *BroadcastError) Error () string {
+	return "broadcast failed for " + joinPeerErrs("peer", e.Errs)
+}
+
+func (e *BroadcastError) Unwrap () []error {
+	return peerErrs(e.Errs)
+}
+
+// joinPeerErrs lists the errors of the peers, sorted by peer
+func joinPeerErrs (kind string, errs map[string]error) string {
+	peers := make([]string, 0, len(errs))
+	for id := range errs {
+		peers = append(peers, id)
 	}
+	sort.Strings(peers)
+	msgs := make([]string, len(peers))
+	for i, id := range peers {
+		msgs[i] = fmt.Sprintf("%s %s: %v", kind, id, errs[id])
+	}
+	return strings.Join(msgs, "; ")
 }
 
-func (s *FileServer) broadcast (msg *Message) error {
+func peerErrs (errs map[string]error) []error {
+	list := make([]error, 0, len(errs))
+	for _, err := range errs {
+		list = append(list, err)
+	}
+	return list
+}
+
+// broadcast sends the message to every peer, even if sending it
+// to some of them fails. It returns the peers that the message has
+// been sent to, and a *BroadcastError for the others.
+func (s *FileServer) broadcast (ctx context.Context, peers map[string]p2p.Peer, msg *Message) ([]string, error) {
 	buf := new(bytes.Buffer)
 	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
-		return fmt.Errorf("error while encoding broadcast %v", err)
+		return nil, fmt.Errorf("error while encoding broadcast %v", err)
 	}
-	for _, peer := range s.peers {
-		peer.Send([]byte{p2p.IncomingMessage})
+	sent := []string{}
+	errs := make(map[string]error)
+	for id, peer := range peers {
+		if err := ctx.Err(); err != nil {
+			return sent, err
+		}
 		if err := peer.Send(buf.Bytes()); err != nil {
-			return err
+			errs[id] = err
+			continue
 		}
+		sent = append(sent, id)
 	}
-	return nil
+	if len(errs) > 0 {
+		return sent, &BroadcastError{Errs: errs}
+	}
+	return sent, nil
+}
+
+// send encodes the message and sends it to a single peer
+func (s *FileServer) send (peer p2p.Peer, msg *Message) error {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return fmt.Errorf("error while encoding message %v", err)
+	}
+	return peer.Send(buf.Bytes())
 }
 
 type Message struct {
+	// RequestID is set on requests and copied into their
+	// responses, so responses can be matched with the caller
+	RequestID uint64
+	Response bool
 	Payload any
 }
 
+// MessageStoreFile announces a file that the sender is going to
+// write on the stream with id StreamID
 type MessageStoreFile struct {
 	ID string
 	Key string
 	Size int64
+	StreamID uint32
+	// Version is given to the write by the node owning the file
+	Version int64
 }
 
+// MessageGetFile asks the receiver to write the file on the
+// stream with id StreamID, opened by the sender
 type MessageGetFile struct {
 	ID string
 	Key string
+	StreamID uint32
 }
 
+// MessageDeleteFile asks the receiver to delete the file, unless its
+// copy has been written by the owner after the delete, i.e. has a
+// version newer than Version
 type MessageDeleteFile struct {
 	ID string
 	Key string
+	Version int64
+}
+
+// MessageStoreFileResponse is sent once the file of a
+// MessageStoreFile request has been synced to disk. Digest is the
+// sha256 of the stored bytes.
+type MessageStoreFileResponse struct {
+	Size int64
+	Digest []byte
+	Err string
+}
+
+// MessageGetFileResponse tells whether the receiver has the file of
+// a MessageGetFile request. If it has, the file is written on the
+// stream right after the response. Digest is the sha256 of the file.
+type MessageGetFileResponse struct {
+	Have bool
+	Size int64
+	Digest []byte
+	Err string
+}
+
+// MessageDeleteFileResponse tells whether the file has been deleted.
+// A receiver that kept a newer copy sends its Version.
+type MessageDeleteFileResponse struct {
+	Deleted bool
+	Version int64
+	Err string
 }
 
 func (s *FileServer) Get (key string) (io.Reader, error) {
+	return s.GetContext(context.Background(), key)
+}
+
+// GetContext is like Get, but stops fetching the file from the
+// network once ctx is done. A partially received file is removed
+// from the store.
+func (s *FileServer) GetContext (ctx context.Context, key string) (io.Reader, error) {
+	return s.GetWithConsistency(ctx, key, s.ReadConsistency)
+}
+
+// GetWithConsistency is like GetContext, but waits for the answers of
+// the replicas required by level instead of ReadConsistency. It fails
+// with ErrNotFound when no node has the file.
+func (s *FileServer) GetWithConsistency (ctx context.Context, key string, level Consistency) (io.Reader, error) {
+	ctx, done, err := s.beginOp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
 	if s.store.Has(s.ID, key) {
 		log.Printf("[%s] serving file (%s) from local disk\n", s.Transport.Addr(), key)
 		_, r, err := s.store.Read(s.ID, key)
@@ -91,80 +329,108 @@ func (s *FileServer) Get (key string) (io.Reader, error) {
 	}
 
 	fmt.Printf("[%s] doesn't have file (%s) locally, fetching from network\n", s.Transport.Addr(), key)
-	
-	msg := Message {
-		Payload: MessageGetFile{
-			ID: s.ID,
-			Key: crypto.HashKey(key),
-		},
-	}
 
-	// Broadcast the key to other peers to check if they
-	// have the file stored
-	if err := s.broadcast(&msg); err != nil {
+	// Ask the replicas of the file first. If the membership changed
+	// since it was stored, the DHT knows who holds it.
+	replicas, _ := s.replicas(s.ID, key, s.peers.snapshot())
+	found, err := s.fetch(ctx, key, replicas, level.required(len(replicas)))
+	if err != nil {
 		return nil, err
 	}
-
-	time.Sleep(time.Millisecond * 500)
-
-	for _, peer := range s.peers {
-		// First read the fileSize
-		var fileSize int64
-		binary.Read(peer, binary.LittleEndian, &fileSize)
-		n, err := s.store.WriteDecrypt(s.EncKey, s.ID, key, io.LimitReader(peer, fileSize))
-		if err != nil {
+	if !found {
+		log.Printf("[%s] no replica has file (%s), looking up its providers\n", s.Transport.Addr(), key)
+		providers, release, err := s.findProviders(ctx, key, replicas)
+		if err != nil && !errors.Is(err, dht.ErrNoContacts) {
+			return nil, err
+		}
+		defer release()
+		if found, err = s.fetch(ctx, key, providers, 1); err != nil {
 			return nil, err
 		}
-		fmt.Printf("[%s] received (%d) bytes over the network from [%s]\n", s.Transport.Addr(), n, peer.RemoteAddr().String())
-		
-		peer.CloseStream()
 	}
-	
+	if !found {
+		return nil, fmt.Errorf("[%s] %w: %s", s.Transport.Addr(), ErrNotFound, key)
+	}
+
 	_, r, err := s.store.Read(s.ID, key)
 	return r, err
 }
 
 func (s *FileServer) Store (key string, r io.Reader) error {
+	return s.StoreContext(context.Background(), key, r)
+}
+
+// StoreContext is like Store, but stops reading r and sending the
+// file to the peers once ctx is done. The peers remove the partially
+// received file when the stream is closed early.
+func (s *FileServer) StoreContext (ctx context.Context, key string, r io.Reader) error {
+	return s.StoreWithConsistency(ctx, key, r, s.WriteConsistency)
+}
+
+// StoreWithConsistency is like StoreContext, but waits for the
+// replicas required by level instead of WriteConsistency. It fails
+// with ErrWriteConsistency when too many replicas could not store
+// the file, even after retrying.
+func (s *FileServer) StoreWithConsistency (ctx context.Context, key string, r io.Reader, level Consistency) error {
+	ctx, done, err := s.beginOp(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+
 	var (
 		fileBuffer = new(bytes.Buffer)
-		tee = io.TeeReader(r, fileBuffer)
+		tee = io.TeeReader(contextReader{ctx: ctx, r: r}, fileBuffer)
 	)
 
-	size, err := s.store.Write(s.ID, key, tee);
+	version := s.nextVersion()
+	size, err := s.store.WriteVersion(s.ID, key, version, tee);
 	if err != nil {
+		s.store.Delete(s.ID, key)
 		return err
 	}
-	msg := Message {
-		Payload: MessageStoreFile {
-			ID: s.ID,
-			Key: crypto.HashKey(key),
-			Size: size + 16,
-		},
-	}
-  
-	// Sending the key and size of message to all peers
-	if err := s.broadcast(&msg); err != nil {
+	fmt.Printf("[%s] Received and written (%d) bytes to disk\n", s.Transport.Addr(), size)
+	// a file stored again is no longer deleted
+	if err := s.tombstones.remove(s.ID, crypto.HashKey(key)); err != nil {
 		return err
 	}
-	
-	time.Sleep(time.Millisecond * 5)
-	
-	peers := []io.Writer{}
-	for _, peer := range s.peers {
-		peers = append(peers, peer)
-	}
-	mw := io.MultiWriter(peers...)
-	mw.Write([]byte{p2p.IncomingStream})
-	n, err := crypto.CopyEncrypt(s.EncKey, fileBuffer, mw)
-	if err != nil {
+
+	// The file is encrypted once, so every replica holds the same
+	// ciphertext, also when it is sent again
+	ciphertext := new(bytes.Buffer)
+	if _, err := crypto.CopyEncrypt(s.EncKey, contextReader{ctx: ctx, r: fileBuffer}, ciphertext); err != nil {
 		return err
 	}
 
-	fmt.Printf("[%s] Received and written (%d) bytes to disk\n", s.Transport.Addr(), n)
+	// Only the replicas chosen by the ring get a copy, the local
+	// copy counts if the local node is one of them
+	peers, _ := s.replicas(s.ID, key, s.peers.snapshot())
+	replicas, local := len(peers), 0
+	if s.isReplica(s.ID, key) {
+		replicas, local = replicas + 1, 1
+	}
+	need := max(level.required(replicas) - local, 0)
+	if err := s.replicate(ctx, crypto.HashKey(key), version, ciphertext.Bytes(), peers, need); err != nil {
+		return fmt.Errorf("[%s] storing file (%s) with consistency %s: %w", s.Transport.Addr(), key, level, err)
+	}
+	s.provide(s.ID, crypto.HashKey(key))
 	
 	return nil
 }
 
+// nextVersion returns the version of a write or a delete of a file
+// owned by this node. Versions follow the clock of the node, so they
+// keep growing across restarts, and are never given twice.
+func (s *FileServer) nextVersion () int64 {
+	for {
+		last := s.lastVersion.Load()
+		version := max(time.Now().UnixNano(), last + 1)
+		if s.lastVersion.CompareAndSwap(last, version) {
+			return version
+		}
+	}
+}
+
 /*
 	Delete will delete the specified key in the current node
 	and across all other nodes in the network. It sends the
@@ -173,46 +439,184 @@ func (s *FileServer) Store (key string, r io.Reader) error {
 	was successful or not.
 */
 func (s *FileServer) Delete (key string) error {
-	err := s.store.Delete(s.ID, key);
+	return s.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext is like Delete, but stops waiting for the responses
+// of the other nodes once ctx is done. A tombstone is kept for the
+// nodes that may hold a copy and did not confirm the delete, they get
+// it again when they reconnect, see catchUp.
+func (s *FileServer) DeleteContext (ctx context.Context, key string) error {
+	ctx, done, err := s.beginOp(ctx)
 	if err != nil {
 		return err
 	}
+	defer done()
+
+	if err := s.store.Delete(s.ID, key); err != nil {
+		return err
+	}
+	peers := s.peers.snapshot()
+	tombstone := Tombstone{
+		ID: s.ID,
+		Key: crypto.HashKey(key),
+		Version: s.nextVersion(),
+		DeletedAt: time.Now(),
+	}
+	// only the nodes that may hold a copy have to confirm, also the
+	// ones that are offline right now
+	if err := s.tombstones.add(tombstone, s.holders(ctx, key)); err != nil {
+		return err
+	}
+
+	req := s.newRequest(ctx, len(peers))
+	defer s.finishRequest(req)
+
 	msg := Message {
+		RequestID: req.id,
 		Payload: MessageDeleteFile {
-			ID: s.ID,
-			Key: crypto.HashKey(key),
+			ID: tombstone.ID,
+			Key: tombstone.Key,
+			Version: tombstone.Version,
 		},
 	}
-  
+	  
 	// Sending the key and size of message to all peers
 	fmt.Printf("[%s] sending delete command to all nodes in the network\n", s.Transport.Addr())
-	if err := s.broadcast(&msg); err != nil {
-		return err
+	sent, broadcastErr := s.broadcast(ctx, peers, &msg)
+	if ctx.Err() != nil {
+		return ctx.Err()
 	}
 
-	time.Sleep(time.Millisecond * 5)
+	// Only wait for the peers that got the message, the
+	// others are reported by broadcastErr
+	responses, err := s.awaitResponses(ctx, req, sent)
+	var failed error
+	for addr, resp := range responses {
+		rErr := responseErr(resp)
+		if rErr == nil {
+			rErr = tombstone.confirmedBy(resp)
+		}
+		if rErr != nil {
+			failed = fmt.Errorf("[%s] peer %s failed to delete file (%s): %v", s.Transport.Addr(), addr, key, rErr)
+			continue
+		}
+		if cErr := s.tombstones.confirm(tombstone.ID, tombstone.Key, tombstone.Version, addr); cErr != nil {
+			return cErr
+		}
+	}
+	if err != nil {
+		return errors.Join(err, broadcastErr)
+	}
+	if failed != nil {
+		return failed
+	}
 	
-	return nil
+	return broadcastErr
 }
 
+// Stop is Shutdown without a deadline
 func (s *FileServer) Stop() {
-	close (s.quitch)
+	s.Shutdown(context.Background())
+}
+
+// WorkerStats returns the load of the message handlers
+func (s *FileServer) WorkerStats () WorkerPoolStats {
+	return s.workers.stats()
+}
+
+// Tombstones returns the deletes that some nodes have not
+// confirmed yet
+func (s *FileServer) Tombstones () []Tombstone {
+	return s.tombstones.list()
+}
+
+// PeerStates returns the connection state of every node the
+// server keeps a connection with
+func (s *FileServer) PeerStates () []p2p.PeerStatus {
+	return s.connMgr.States()
 }
 
 func (s *FileServer) onPeer (p p2p.Peer) error {
 	s.peerLock.Lock()
 	defer s.peerLock.Unlock()
-	s.peers[p.RemoteAddr().String()] = p
+	old, ok := s.peers.add(p, func (old p2p.Peer) bool {
+		return s.preferConn(p, old)
+	})
+	// the node dialed us as well, so the connection we settle on is
+	// wanted by both of us, even if ours is meant for a lookup only
+	if !p.Outbound() {
+		s.keepConn(p.Info().ListenAddr)
+	}
+	if !ok {
+		return fmt.Errorf("[%s] already connected with %s", s.Transport.Addr(), p.ID())
+	}
+	if old != nil {
+		log.Printf("[%s] replacing connection with %s", s.Transport.Addr(), p.ID())
+		old.Close()
+	}
+	// the node that dialed keeps the connection, so connections
+	// opened by others only for a lookup are not kept
+	if p.Outbound() {
+		s.connMgr.Connected(p.Info().ListenAddr, p.ID())
+	} else {
+		s.connMgr.Accepted(p.Info().ListenAddr, p.ID())
+	}
+	s.ring.Add(p.ID())
+	s.dht.Update(peerContact(p))
+	s.catchUp(p)
+	// the first peer is the way into the DHT
+	if s.peers.len() == 1 {
+		s.refreshDHT()
+	}
+
+	log.Printf("conncted with remote: %s (%s) listening on %s", p.RemoteAddr(), p.ID(), p.Info().ListenAddr)
+
+	// tell the new peer about the rest of the cluster right away
+	go func () {
+		if err := s.sendPeerExchange(p); err != nil {
+			log.Printf("[%s] peer exchange with %s failed: %v", s.Transport.Addr(), p.ID(), err)
+		}
+	}()
 
-	log.Printf("conncted with remote: %s", p.RemoteAddr())
-	
 	return nil
 }
 
+// preferConn decides whether the new connection p replaces the
+// existing connection old to the same node. When two nodes dial each
+// other at the same time, both keep the connection dialed by the node
+// with the smaller ID, so they agree without talking to each other.
+// A connection in the same direction as the old one is a reconnect
+// and always wins.
+func (s *FileServer) preferConn (p p2p.Peer, old p2p.Peer) bool {
+	if p.Outbound() == old.Outbound() {
+		return true
+	}
+	dialer := p.ID()
+	if p.Outbound() {
+		dialer = s.ID
+	}
+	return dialer == min(s.ID, p.ID())
+}
+
+// onPeerDisconnect removes the peer from the peer map, unless it
+// has been replaced by a newer connection to the same node already
+func (s *FileServer) onPeerDisconnect (p p2p.Peer) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	if !s.peers.remove(p) {
+		return
+	}
+	s.connMgr.Disconnected(p.Info().ListenAddr)
+	s.ring.Remove(p.ID())
+
+	log.Printf("[%s] disconnected from remote: %s (%s)", s.Transport.Addr(), p.RemoteAddr(), p.ID())
+}
+
 func (s *FileServer) loop() {
 	defer func () {
 		fmt.Println("file server stopped due to error or user quit action")
-		s.Transport.Close()
+		s.routines.Done()
 	}()
 	for {
 		select {
@@ -220,37 +624,107 @@ func (s *FileServer) loop() {
 			var msg Message
 			if err := gob.NewDecoder(bytes.NewReader(rpc.Payload)).Decode(&msg); err != nil {
 				log.Println("error while decoding received message:", err)
+				continue
 			}
-			if err := s.handleMessage(rpc.From, &msg); err != nil {
-				log.Println("handle message error:", err)
+			// responses only wake up the waiting request
+			if msg.Response {
+				if err := s.handleResponse(rpc.From, &msg); err != nil {
+					log.Println("handle message error:", err)
+				}
+				continue
 			}
+			// blocks while all the workers are busy and the queue
+			// is full, the transport holds the messages back then
+			s.workers.submit(orderKey(rpc.From, &msg), func () {
+				if err := s.handleMessage(rpc.From, &msg); err != nil {
+					log.Println("handle message error:", err)
+				}
+			})
 		case <- s.quitch:
 			return
 		}
 	}
 }
 
+// orderKey returns the key of the messages that have to be handled
+// in order. The messages of a peer about the same file are handled in
+// the order they were sent, so a delete never overtakes a store.
+func orderKey (from string, msg *Message) string {
+	switch v := msg.Payload.(type) {
+	case MessageStoreFile:
+		return from + "/" + v.Key
+	case MessageGetFile:
+		return from + "/" + v.Key
+	case MessageDeleteFile:
+		return from + "/" + v.Key
+	}
+	return ""
+}
+
 func (s *FileServer) handleMessage (from string, msg* Message) error {
+	if msg.Response {
+		return s.handleResponse(from, msg)
+	}
 	switch v := msg.Payload.(type) {
 	case MessageStoreFile:
-		return s.handleMessageStoreFile(from, v)
+		return s.handleMessageStoreFile(from, msg.RequestID, v)
 	case MessageGetFile:
-		return s.handleMessageGetFile(from, v)
+		return s.handleMessageGetFile(from, msg.RequestID, v)
 	case MessageDeleteFile:
-		return s.handleMessageDeleteFile(from, v)
+		return s.handleMessageDeleteFile(from, msg.RequestID, v)
+	case MessagePeerExchange:
+		return s.handleMessagePeerExchange(from, v)
+	case MessageFindNode:
+		return s.handleMessageFindNode(from, msg.RequestID, v)
+	case MessageFindValue:
+		return s.handleMessageFindValue(from, msg.RequestID, v)
+	case MessageAddProvider:
+		return s.handleMessageAddProvider(from, msg.RequestID, v)
 	}
 	return nil
 }
 
-func (s *FileServer) handleMessageGetFile (from string, msg MessageGetFile) error {
+// reply sends the response to the request with the given id
+func (s *FileServer) reply (peer p2p.Peer, requestID uint64, payload any) error {
+	msg := Message{
+		RequestID: requestID,
+		Response: true,
+		Payload: payload,
+	}
+	return s.send(peer, &msg)
+}
+
+func (s *FileServer) handleMessageGetFile (from string, requestID uint64, msg MessageGetFile) error {
+	peer, ok := s.peers.get(from)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+
+	st, err := peer.AcceptStream(msg.StreamID)
+	if err != nil {
+		return err
+	}
+	// Closing the stream tells the requesting peer that we are done,
+	// even when we don't have the file
+	defer st.Close()
+
 	if !s.store.Has(msg.ID, msg.Key) {
-		return fmt.Errorf("[%s] need to serve file (%s) but it does not exist on disk", s.Transport.Addr(), msg.Key)
+		log.Printf("[%s] asked for file (%s) that does not exist on disk", s.Transport.Addr(), msg.Key)
+		return s.reply(peer, requestID, MessageGetFileResponse{Have: false})
 	}
 
 	log.Printf("[%s] serving file (%s) over the network\n", s.Transport.Addr(), msg.Key)
 	
+	// the digest recorded when the file was written, so the reply
+	// doesn't wait for the whole file to be hashed
+	_, digest, err := s.store.Digest(msg.ID, msg.Key)
+	if err != nil {
+		s.reply(peer, requestID, MessageGetFileResponse{Err: err.Error()})
+		return err
+	}
 	fileSize, r, err := s.store.Read(msg.ID, msg.Key);
 	if err != nil {
+		s.reply(peer, requestID, MessageGetFileResponse{Err: err.Error()})
 		return err
 	}
 	
@@ -258,16 +732,14 @@ func (s *FileServer) handleMessageGetFile (from string, msg MessageGetFile) erro
 		log.Println("closing ReadCloser")
 		defer rc.Close()
 	}
-	
-	peer, ok := s.peers[from]
-	if !ok {
-		return fmt.Errorf("peer %s not in map", peer)
-	}
 
-	// First send the "IncomingStream" byte, then send fileSize
-	peer.Send([]byte{p2p.IncomingStream})
-	binary.Write(peer, binary.LittleEndian, fileSize)
-	n, err := io.Copy(peer, r)
+	// First answer that we have the file, then send the
+	// contents of the file on the stream. The requesting peer
+	// closes the stream if it reads the file from another peer.
+	if err := s.reply(peer, requestID, MessageGetFileResponse{Have: true, Size: fileSize, Digest: digest}); err != nil {
+		return err
+	}
+	n, err := io.Copy(st, r)
 	if err != nil {
 		return err
 	}
@@ -276,66 +748,103 @@ func (s *FileServer) handleMessageGetFile (from string, msg MessageGetFile) erro
 	return nil
 }
 
-func (s *FileServer) handleMessageStoreFile (from string, msg MessageStoreFile) error {
-	peer, ok := s.peers[from]
+func (s *FileServer) handleMessageStoreFile (from string, requestID uint64, msg MessageStoreFile) error {
+	peer, ok := s.peers.get(from)
 	if !ok {
 		return fmt.Errorf("peer (%s) could not be found in the peer map", from)
 	}
-	n, err := s.store.Write(msg.ID, msg.Key, io.LimitReader(peer, msg.Size));
+	st, err := peer.AcceptStream(msg.StreamID)
 	if err != nil {
 		return err
 	}
+	defer st.Close()
 
-	log.Printf("[%s] written (%d) bytes to disk\n", s.Transport.Addr(), n)
+	n, err := s.store.WriteVersion(msg.ID, msg.Key, msg.Version, io.LimitReader(st, msg.Size));
+	if err == nil && n != msg.Size {
+		err = fmt.Errorf("[%s] expected (%d) bytes for file (%s) but received (%d)", s.Transport.Addr(), msg.Size, msg.Key, n)
+	}
+	if err != nil {
+		// the sender gave up or went away, don't keep half a file
+		s.store.Delete(msg.ID, msg.Key)
+		s.reply(peer, requestID, MessageStoreFileResponse{Size: n, Err: err.Error()})
+		return err
+	}
 
-	peer.CloseStream()
+	log.Printf("[%s] written (%d) bytes to disk\n", s.Transport.Addr(), n)
 
-	return nil
+	// the store recorded the digest while writing the file
+	_, digest, err := s.store.Digest(msg.ID, msg.Key)
+	if err != nil {
+		s.reply(peer, requestID, MessageStoreFileResponse{Size: n, Err: err.Error()})
+		return err
+	}
+	s.provide(msg.ID, msg.Key)
+	return s.reply(peer, requestID, MessageStoreFileResponse{Size: n, Digest: digest})
 }
 
 /* This function contains logic to delete the specified file from peers
 */
-func (s *FileServer) handleMessageDeleteFile (from string, msg MessageDeleteFile) error {
+func (s *FileServer) handleMessageDeleteFile (from string, requestID uint64, msg MessageDeleteFile) error {
+	peer, ok := s.peers.get(from)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+
+	// Not having the file is not an error for the requesting
+	// peer, there is simply nothing to delete
 	if !s.store.Has(msg.ID, msg.Key) {
-		return fmt.Errorf("[%s] need to delete file (%s) but it does not exist on disk", s.Transport.Addr(), msg.Key)
+		return s.reply(peer, requestID, MessageDeleteFileResponse{Deleted: false})
 	}
 
-	peer, ok := s.peers[from]
-	if !ok {
-		return fmt.Errorf("peer %s not in map", peer)
+	// the owner has stored the file again since it was deleted
+	if meta, err := s.store.Meta(msg.ID, msg.Key); err == nil && meta.Version > msg.Version {
+		log.Printf("[%s] keeping file (%s), it is newer than the delete", s.Transport.Addr(), msg.Key)
+		return s.reply(peer, requestID, MessageDeleteFileResponse{Deleted: false, Version: meta.Version})
 	}
 
 	log.Printf("[%s] found file (%s), deleting it...\n", s.Transport.Addr(), msg.Key)
 
 	if err := s.store.Delete(msg.ID, msg.Key); err != nil {
-		return fmt.Errorf("[%s] error while deleting file (%s): %v", s.Transport.Addr(), msg.Key, err)
+		err = fmt.Errorf("[%s] error while deleting file (%s): %v", s.Transport.Addr(), msg.Key, err)
+		s.reply(peer, requestID, MessageDeleteFileResponse{Err: err.Error()})
+		return err
 	}
 
 	log.Printf("[%s] successfully deleted file (%s)", s.Transport.Addr(), msg.Key)
 
-	return nil
+	return s.reply(peer, requestID, MessageDeleteFileResponse{Deleted: true})
 }
 
+// bootstrapNetwork hands the bootstrap nodes to the connection
+// manager, which keeps dialing them until they are connected
 func (s *FileServer) bootstrapNetwork() error {
 	for _, addr := range s.BootstrapNodes {
 		if len(addr) == 0 {
 			continue
 		}
-		go func (addr string) {
-			fmt.Printf("[%s] attempting to connect with remote:%s\n", s.Transport.Addr(), addr)
-			if err := s.Transport.Dial(addr); err != nil {
-				fmt.Println("dial error", err)
-			}
-		}(addr)
+		fmt.Printf("[%s] attempting to connect with remote:%s\n", s.Transport.Addr(), addr)
+		s.connMgr.Add(addr)
 	}
 	return nil
 }
 
 func (s *FileServer) Start () error {
+	s.opsLock.Lock()
+	if s.stopping {
+		s.opsLock.Unlock()
+		return ErrServerStopped
+	}
+	s.routines.Add(4)
+	s.opsLock.Unlock()
+
 	if err := s.Transport.ListenAndAccept(); err != nil {
+		s.routines.Add(-4)
 		return err
 	}
 	s.bootstrapNetwork()
+	go s.pexLoop()
+	go s.dhtLoop()
+	go s.tombstoneLoop()
 	s.loop()
 	return nil
 }
@@ -344,4 +853,14 @@ func init () {
 	gob.Register(MessageStoreFile{})
 	gob.Register(MessageGetFile{})
 	gob.Register(MessageDeleteFile{})
+	gob.Register(MessageStoreFileResponse{})
+	gob.Register(MessageGetFileResponse{})
+	gob.Register(MessageDeleteFileResponse{})
+	gob.Register(MessagePeerExchange{})
+	gob.Register(MessageFindNode{})
+	gob.Register(MessageFindNodeResponse{})
+	gob.Register(MessageFindValue{})
+	gob.Register(MessageFindValueResponse{})
+	gob.Register(MessageAddProvider{})
+	gob.Register(MessageAddProviderResponse{})
 }
\ No newline at end of file
@@ -0,0 +1,570 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/priyangshupal/distributed-file-system/crypto"
+	"github.com/priyangshupal/distributed-file-system/dht"
+	"github.com/priyangshupal/distributed-file-system/p2p"
+	"github.com/priyangshupal/distributed-file-system/store"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestServer starts a server on the network, injecting the faults
+// of fi on its connections unless fi is nil
+func newTestServer (t *testing.T, network *p2p.MemNetwork, fi *p2p.FaultInjector, listenAddr string, nodes ...string) *FileServer {
+	identityKey, err := crypto.NewIdentityKey()
+	assert.Nil(t, err)
+	transport := p2p.NewMemTransport(p2p.MemTransportOpts{
+		Network: network,
+		ListenAddr: listenAddr,
+		PeerOpts: p2p.PeerOpts{
+			HandshakeFunc: p2p.NewHandshakeFunc(p2p.HandshakeOpts{
+				IdentityKey: identityKey,
+				ListenAddr: listenAddr,
+			}),
+		},
+	})
+	var tr p2p.Transport = transport
+	if fi != nil {
+		tr = fi.Wrap(transport)
+	}
+	s := NewFileServer(FileServerOpts{
+		IdentityKey: identityKey,
+		EncKey: crypto.NewEncryptionKey(),
+		StorageRoot: t.TempDir(),
+		PathTransformFunc: store.CASPathTransformFunc,
+		Transport: tr,
+		BootstrapNodes: nodes,
+		RequestTimeout: time.Second,
+	})
+	transport.OnPeer = s.onPeer
+	transport.OnPeerDisconnect = s.onPeerDisconnect
+	go s.Start()
+	t.Cleanup(s.Stop)
+	return s
+}
+
+// newTestCluster starts n servers that only know the first one and
+// waits until peer exchange has connected all of them
+func newTestCluster (t *testing.T, n int, fi *p2p.FaultInjector) []*FileServer {
+	network := p2p.NewMemNetwork()
+	servers := []*FileServer{newTestServer(t, network, fi, "node0")}
+	for i := 1; i < n; i++ {
+		servers = append(servers, newTestServer(t, network, fi, fmt.Sprintf("node%d", i), "node0"))
+	}
+	assert.Eventually(t, func () bool {
+		for _, s := range servers {
+			if s.peers.len() != n - 1 {
+				return false
+			}
+		}
+		return true
+	}, time.Second * 5, time.Millisecond * 10)
+	return servers
+}
+
+func TestPeerExchangeTargetPeers (t *testing.T) {
+	s := newTestServer(t, p2p.NewMemNetwork(), nil, "node0")
+	s.TargetPeers = 2
+	// a node that is gone does not count towards the target
+	s.connMgr.Add("gone")
+	assert.Eventually(t, func () bool {
+		states := s.connMgr.States()
+		return len(states) == 1 && states[0].State == p2p.StateBackoff
+	}, time.Second, time.Millisecond * 10)
+
+	assert.Nil(t, s.handleMessagePeerExchange("node1", MessagePeerExchange{Peers: []PeerRecord{
+		{ID: "a", Addr: "a"},
+		{ID: "b", Addr: "b"},
+		{ID: "c", Addr: "c"},
+	}}))
+	addrs := []string{}
+	for _, st := range s.connMgr.States() {
+		addrs = append(addrs, st.Addr)
+	}
+	slices.Sort(addrs)
+	assert.Equal(t, []string{"a", "b", "gone"}, addrs)
+}
+
+func TestClusterStoreGetDelete (t *testing.T) {
+	servers := newTestCluster(t, 3, nil)
+	s := servers[1]
+	key := "picture.png"
+	data := []byte("my big data file here!")
+
+	assert.Nil(t, s.Store(key, bytes.NewReader(data)))
+	for _, other := range []*FileServer{servers[0], servers[2]} {
+		assert.True(t, other.store.Has(s.ID, crypto.HashKey(key)))
+	}
+
+	// drop the local copy, so the file is fetched from the network
+	assert.Nil(t, s.store.Delete(s.ID, key))
+	r, err := s.Get(key)
+	assert.Nil(t, err)
+	b, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, data, b)
+	if rc, ok := r.(io.Closer); ok {
+		rc.Close()
+	}
+
+	assert.Nil(t, s.Delete(key))
+	assert.False(t, s.store.Has(s.ID, key))
+	for _, other := range []*FileServer{servers[0], servers[2]} {
+		assert.False(t, other.store.Has(s.ID, crypto.HashKey(key)))
+	}
+	// every node confirmed, nothing to remember
+	assert.Empty(t, s.Tombstones())
+}
+
+func TestClusterReplication (t *testing.T) {
+	servers := newTestCluster(t, 5, nil)
+	s := servers[0]
+	key := "picture.png"
+	data := []byte("my big data file here!")
+	assert.Nil(t, s.Store(key, bytes.NewReader(data)))
+
+	// only the replicas picked by the ring hold a copy
+	replicas := s.ring.Lookup(placementKey(s.ID, key), s.ReplicationFactor)
+	assert.Len(t, replicas, 3)
+	for _, other := range servers[1:] {
+		assert.Equal(t, slices.Contains(replicas, other.ID), other.store.Has(s.ID, crypto.HashKey(key)))
+	}
+
+	assert.Nil(t, s.store.Delete(s.ID, key))
+	r, err := s.Get(key)
+	assert.Nil(t, err)
+	b, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, data, b)
+	if rc, ok := r.(io.Closer); ok {
+		rc.Close()
+	}
+}
+
+func TestClusterDHTLookup (t *testing.T) {
+	servers := newTestCluster(t, 5, nil)
+	s := servers[0]
+	key := "picture.png"
+	data := []byte("my big data file here!")
+	assert.Nil(t, s.Store(key, bytes.NewReader(data)))
+
+	// every node holding the file announces itself, the replicas and
+	// s with its local copy. Ask a node that doesn't hold it.
+	replicas := s.ring.Lookup(placementKey(s.ID, key), s.ReplicationFactor)
+	holders := len(replicas)
+	if !slices.Contains(replicas, s.ID) {
+		holders++
+	}
+	other := servers[1]
+	for _, o := range servers[1:] {
+		if !slices.Contains(replicas, o.ID) {
+			other = o
+		}
+	}
+	assert.Eventually(t, func () bool {
+		providers, err := other.dht.FindProviders(context.Background(), fileID(s.ID, crypto.HashKey(key)))
+		return err == nil && len(providers) == holders
+	}, time.Second * 5, time.Millisecond * 10)
+
+	// after the replicas left the ring, only the DHT knows where
+	// the file is
+	for _, id := range replicas {
+		s.ring.Remove(id)
+	}
+	assert.Nil(t, s.store.Delete(s.ID, key))
+	r, err := s.Get(key)
+	assert.Nil(t, err)
+	b, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, data, b)
+	if rc, ok := r.(io.Closer); ok {
+		rc.Close()
+	}
+}
+
+func TestClusterDHTRepublish (t *testing.T) {
+	servers := newTestCluster(t, 3, nil)
+	s, holder := servers[0], servers[2]
+	hashedKey := crypto.HashKey("picture.png")
+
+	// a copy that was never announced, like one whose provider
+	// records expired
+	_, err := holder.store.Write(s.ID, hashedKey, bytes.NewReader([]byte("my big data file here!")))
+	assert.Nil(t, err)
+	providers, err := servers[1].dht.FindProviders(context.Background(), fileID(s.ID, hashedKey))
+	assert.Nil(t, err)
+	assert.Empty(t, providers)
+
+	assert.Nil(t, holder.republish(context.Background()))
+	providers, err = servers[1].dht.FindProviders(context.Background(), fileID(s.ID, hashedKey))
+	assert.Nil(t, err)
+	assert.Len(t, providers, 1)
+	assert.Equal(t, holder.ID, providers[0].ID.String())
+}
+
+func TestClusterDHTConnectRelease (t *testing.T) {
+	network := p2p.NewMemNetwork()
+	servers := []*FileServer{newTestServer(t, network, nil, "node0")}
+	servers = append(servers, newTestServer(t, network, nil, "node1", "node0"))
+	s := servers[0]
+	assert.Eventually(t, func () bool {
+		return s.peers.len() == 1
+	}, time.Second * 5, time.Millisecond * 10)
+	// node2 is in no one's bootstrap nodes, it is only reached
+	// through the DHT
+	other := newTestServer(t, network, nil, "node2")
+	managed := func (addr string) bool {
+		for _, st := range s.PeerStates() {
+			if st.Addr == addr {
+				return true
+			}
+		}
+		return false
+	}
+
+	ctx := context.Background()
+	contact := dht.Contact{ID: nodeID(other.ID), Addr: "node2"}
+	p, release, err := s.connect(ctx, contact)
+	assert.Nil(t, err)
+	_, again, err := s.connect(ctx, contact)
+	assert.Nil(t, err)
+	assert.True(t, managed("node2"))
+
+	// the connection is kept until the last user releases it
+	release()
+	assert.True(t, managed("node2"))
+	assert.Nil(t, p.Send([]byte("still open")))
+	again()
+	assert.False(t, managed("node2"))
+	assert.Eventually(t, func () bool {
+		return p.Send([]byte("closed")) != nil
+	}, time.Second, time.Millisecond * 10)
+
+	// connections the server keeps anyway stay
+	_, release, err = s.connect(ctx, dht.Contact{ID: nodeID(servers[1].ID), Addr: "node1"})
+	assert.Nil(t, err)
+	release()
+	_, ok := s.peers.get(servers[1].ID)
+	assert.True(t, ok)
+}
+
+func TestClusterDHTConnectKept (t *testing.T) {
+	network := p2p.NewMemNetwork()
+	lo, hi := newTestServer(t, network, nil, "node0"), newTestServer(t, network, nil, "node1")
+	if hi.ID < lo.ID {
+		lo, hi = hi, lo
+	}
+
+	// both nodes settle on the connection dialed by the node with
+	// the smaller ID, even if it is only meant for a lookup
+	p, release, err := lo.connect(context.Background(), dht.Contact{ID: nodeID(hi.ID), Addr: hi.Transport.Addr()})
+	assert.Nil(t, err)
+	hi.connMgr.Add(lo.Transport.Addr())
+	assert.Eventually(t, func () bool {
+		lo.lookupLock.Lock()
+		defer lo.lookupLock.Unlock()
+		return len(lo.lookupConns) == 0
+	}, time.Second, time.Millisecond * 10)
+
+	release()
+	assert.Never(t, func () bool {
+		q, ok := lo.peers.get(hi.ID)
+		return !ok || q != p
+	}, time.Millisecond * 200, time.Millisecond * 10)
+}
+
+func TestClusterGetNotFound (t *testing.T) {
+	servers := newTestCluster(t, 3, nil)
+	start := time.Now()
+	_, err := servers[0].Get("missing.png")
+	assert.ErrorIs(t, err, ErrNotFound)
+	// every peer answers, nobody waits for a timeout
+	assert.Less(t, time.Since(start), servers[0].RequestTimeout)
+}
+
+// answerWrongly answers the requests of s as the node from with a
+// response of an unexpected type, until done is closed
+func answerWrongly (t *testing.T, s *FileServer, from string, done chan struct{}) {
+	answered := make(map[uint64]bool)
+	for {
+		select {
+		case <- done:
+			return
+		case <- time.After(time.Millisecond):
+		}
+		s.pendingLock.Lock()
+		ids := []uint64{}
+		for id := range s.pending {
+			if !answered[id] {
+				answered[id] = true
+				ids = append(ids, id)
+			}
+		}
+		s.pendingLock.Unlock()
+		for _, id := range ids {
+			assert.Nil(t, s.handleResponse(from, &Message{RequestID: id, Response: true, Payload: MessageAddProviderResponse{}}))
+		}
+	}
+}
+
+func TestClusterGetWrongResponse (t *testing.T) {
+	fi := p2p.NewFaultInjector(1)
+	servers := newTestCluster(t, 2, fi)
+	s := servers[0]
+	key := "picture.png"
+	assert.Nil(t, s.Store(key, bytes.NewReader([]byte("my big data file here!"))))
+	assert.Nil(t, s.store.Delete(s.ID, key))
+
+	// the real answer of node1 never arrives
+	fi.Partition([]string{"node0"}, []string{"node1"})
+	done := make(chan struct{})
+	go func () {
+		_, err := s.Get(key)
+		assert.ErrorIs(t, err, ErrNotFound)
+		close(done)
+	}()
+	answerWrongly(t, s, servers[1].ID, done)
+}
+
+func TestClusterQuorumRead (t *testing.T) {
+	servers := newTestCluster(t, 4, nil)
+	s := servers[0]
+	// a key that three other nodes hold, so they can outvote one
+	var key string
+	for i := 0; key == "" || s.isReplica(s.ID, key); i++ {
+		key = fmt.Sprintf("picture_%d.png", i)
+	}
+	data := []byte("my big data file here!")
+	assert.Nil(t, s.Store(key, bytes.NewReader(data)))
+
+	replicas, _ := s.replicas(s.ID, key, s.peers.snapshot())
+	assert.Len(t, replicas, 3)
+	for _, other := range servers[1:] {
+		if _, ok := replicas[other.ID]; ok {
+			_, err := other.store.Write(s.ID, crypto.HashKey(key), bytes.NewReader([]byte("corrupted copy of the file")))
+			assert.Nil(t, err)
+			break
+		}
+	}
+
+	assert.Nil(t, s.store.Delete(s.ID, key))
+	r, err := s.GetWithConsistency(context.Background(), key, ConsistencyAll)
+	assert.Nil(t, err)
+	b, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, data, b)
+	if rc, ok := r.(io.Closer); ok {
+		rc.Close()
+	}
+}
+
+func TestClusterPeerDisconnect (t *testing.T) {
+	servers := newTestCluster(t, 2, nil)
+	peer := func () p2p.Peer {
+		for _, p := range servers[0].peers.snapshot() {
+			return p
+		}
+		return nil
+	}
+	old := peer()
+	old.Close()
+
+	// the connection manager of the second node dials the
+	// bootstrap node again
+	assert.Eventually(t, func () bool {
+		p := peer()
+		return p != nil && p != old && servers[1].peers.len() == 1
+	}, time.Second * 5, time.Millisecond * 10)
+}
+
+func TestClusterPartition (t *testing.T) {
+	fi := p2p.NewFaultInjector(1)
+	servers := newTestCluster(t, 3, fi)
+	s := servers[0]
+	data := []byte("my big data file here!")
+
+	// the other nodes never answer while node0 is cut off
+	fi.Partition([]string{"node0"}, []string{"node1", "node2"})
+	err := s.Store("during", bytes.NewReader(data))
+	assert.ErrorIs(t, err, ErrWriteConsistency)
+	assert.ErrorIs(t, err, ErrRequestTimeout)
+	var replicaErr *ReplicaError
+	assert.ErrorAs(t, err, &replicaErr)
+	assert.NotEmpty(t, replicaErr.Errs)
+
+	fi.Heal()
+	fi.SetFaults(p2p.Faults{Latency: time.Millisecond * 10, Jitter: time.Millisecond * 10})
+	assert.Nil(t, s.Store("after", bytes.NewReader(data)))
+	for _, other := range servers[1:] {
+		assert.True(t, other.store.Has(s.ID, crypto.HashKey("after")))
+	}
+}
+
+func TestClusterSlowReplica (t *testing.T) {
+	fi := p2p.NewFaultInjector(1)
+	servers := newTestCluster(t, 3, fi)
+	s := servers[0]
+
+	// the transfer alone takes longer than the request timeout, the
+	// replicas only have to answer within it once they got the file
+	fi.SetFaults(p2p.Faults{Bandwidth: 512 * 1024})
+	data := bytes.Repeat([]byte("slow"), 256 * 1024)
+	assert.Nil(t, s.Store("slow", bytes.NewReader(data)))
+	for _, other := range servers[1:] {
+		assert.True(t, other.store.Has(s.ID, crypto.HashKey("slow")))
+	}
+}
+
+func TestClusterWriteConsistency (t *testing.T) {
+	fi := p2p.NewFaultInjector(1)
+	servers := newTestCluster(t, 3, fi)
+	s := servers[0]
+	data := []byte("my big data file here!")
+	ctx := context.Background()
+
+	// the local copy and node1 are a quorum of the three replicas
+	fi.Partition([]string{"node0", "node1"}, []string{"node2"})
+	assert.Nil(t, s.StoreWithConsistency(ctx, "quorum", bytes.NewReader(data), ConsistencyQuorum))
+	assert.True(t, servers[1].store.Has(s.ID, crypto.HashKey("quorum")))
+
+	// node2 only gets the file once the partition heals, the
+	// retries make the write succeed anyway
+	time.AfterFunc(time.Millisecond * 300, fi.Heal)
+	assert.Nil(t, s.StoreWithConsistency(ctx, "all", bytes.NewReader(data), ConsistencyAll))
+	for _, other := range servers[1:] {
+		assert.True(t, other.store.Has(s.ID, crypto.HashKey("all")))
+	}
+}
+
+func TestClusterStorePartitionedLargeFile (t *testing.T) {
+	fi := p2p.NewFaultInjector(1)
+	servers := newTestCluster(t, 3, fi)
+	s := servers[0]
+
+	// the replicas never get the message announcing the stream, so
+	// they never read more than the flow control window of it
+	fi.Partition([]string{"node0"}, []string{"node1", "node2"})
+	data := bytes.Repeat([]byte("big"), 1024 * 1024)
+	errc := make(chan error, 1)
+	go func () {
+		errc <- s.Store("big", bytes.NewReader(data))
+	}()
+	select {
+	case err := <- errc:
+		assert.ErrorIs(t, err, ErrWriteConsistency)
+	case <- time.After(time.Second * 10):
+		t.Fatal("store of a large file blocked on the partitioned replicas")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+	assert.Nil(t, s.Shutdown(ctx))
+}
+
+func TestClusterDeleteCatchUp (t *testing.T) {
+	fi := p2p.NewFaultInjector(1)
+	servers := newTestCluster(t, 3, fi)
+	s, offline := servers[0], servers[2]
+	key := "picture.png"
+	assert.Nil(t, s.Store(key, bytes.NewReader([]byte("my big data file here!"))))
+
+	// node2 misses the delete
+	fi.Partition([]string{"node0", "node1"}, []string{"node2"})
+	assert.ErrorIs(t, s.Delete(key), ErrRequestTimeout)
+	assert.False(t, servers[1].store.Has(s.ID, crypto.HashKey(key)))
+	assert.True(t, offline.store.Has(s.ID, crypto.HashKey(key)))
+	tombstones := s.Tombstones()
+	assert.Len(t, tombstones, 1)
+	assert.Equal(t, []string{offline.ID}, tombstones[0].Pending)
+
+	// and gets it once it reconnects
+	fi.Heal()
+	p, ok := s.peers.get(offline.ID)
+	assert.True(t, ok)
+	p.Close()
+	assert.Eventually(t, func () bool {
+		return !offline.store.Has(s.ID, crypto.HashKey(key)) && len(s.Tombstones()) == 0
+	}, time.Second * 5, time.Millisecond * 10)
+}
+
+func TestClusterDeletePendingReplicas (t *testing.T) {
+	fi := p2p.NewFaultInjector(1)
+	servers := newTestCluster(t, 5, fi)
+	s := servers[0]
+	key := "picture.png"
+	assert.Nil(t, s.Store(key, bytes.NewReader([]byte("my big data file here!"))))
+	replicas, others := s.replicas(s.ID, key, s.peers.snapshot())
+	var replica, other string
+	for id := range replicas {
+		replica = id
+	}
+	for id := range others {
+		other = id
+	}
+	addr := func (id string) string {
+		for _, o := range servers {
+			if o.ID == id {
+				return o.Transport.Addr()
+			}
+		}
+		return ""
+	}
+
+	// a node that can't hold a copy doesn't have to confirm, a
+	// replica does until it is retired
+	fi.Partition([]string{"node0"}, []string{addr(replica), addr(other)})
+	assert.ErrorIs(t, s.Delete(key), ErrRequestTimeout)
+	tombstones := s.Tombstones()
+	assert.Len(t, tombstones, 1)
+	assert.Equal(t, []string{replica}, tombstones[0].Pending)
+
+	assert.Nil(t, s.RetireNode(replica))
+	assert.Empty(t, s.Tombstones())
+}
+
+func TestClusterDeleteKeepsNewerCopy (t *testing.T) {
+	servers := newTestCluster(t, 2, nil)
+	s, replica := servers[0], servers[1]
+	key := "picture.png"
+	assert.Nil(t, s.Store(key, bytes.NewReader([]byte("my big data file here!"))))
+	meta, err := replica.store.Meta(s.ID, crypto.HashKey(key))
+	assert.Nil(t, err)
+	assert.NotZero(t, meta.Version)
+
+	// a delete sent before the file was stored again keeps the copy
+	p, ok := s.peers.get(replica.ID)
+	assert.True(t, ok)
+	stale := Tombstone{ID: s.ID, Key: crypto.HashKey(key), Version: meta.Version - 1}
+	assert.Nil(t, s.sendDelete(context.Background(), p, stale))
+	assert.True(t, replica.store.Has(s.ID, crypto.HashKey(key)))
+
+	// a later delete removes it
+	assert.Nil(t, s.Delete(key))
+	assert.False(t, replica.store.Has(s.ID, crypto.HashKey(key)))
+	assert.Empty(t, s.Tombstones())
+}
+
+func TestClusterShutdown (t *testing.T) {
+	servers := newTestCluster(t, 3, nil)
+	s := servers[0]
+	assert.Nil(t, s.Store("picture.png", bytes.NewReader([]byte("my big data file here!"))))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+	assert.Nil(t, s.Shutdown(ctx))
+	assert.Equal(t, 0, s.peers.len())
+	assert.ErrorIs(t, s.Store("other.png", bytes.NewReader([]byte("data"))), ErrServerStopped)
+
+	// the other nodes notice that the connection is gone
+	assert.Eventually(t, func () bool {
+		return servers[1].peers.len() == 1 && servers[2].peers.len() == 1
+	}, time.Second * 5, time.Millisecond * 10)
+}
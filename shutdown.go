@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// beginOp registers an operation started by a caller of the server,
+// like a Store or a Get. The returned context is also cancelled when
+// the server gives up waiting for the operation during Shutdown.
+func (s *FileServer) beginOp (ctx context.Context) (context.Context, func (), error) {
+	s.opsLock.Lock()
+	defer s.opsLock.Unlock()
+	if s.stopping {
+		return nil, nil, ErrServerStopped
+	}
+	s.ops.Add(1)
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(s.opsCtx, cancel)
+	return ctx, func () {
+		stop()
+		cancel()
+		s.ops.Done()
+	}, nil
+}
+
+// goOp runs f in the background as an operation of the server, so
+// Shutdown waits for it like for a Store. f is not run at all once
+// the server is stopping.
+func (s *FileServer) goOp (f func (ctx context.Context)) {
+	ctx, done, err := s.beginOp(context.Background())
+	if err != nil {
+		return
+	}
+	go func () {
+		defer done()
+		f(ctx)
+	}()
+}
+
+// Shutdown stops the server gracefully. New operations are refused
+// right away, in-flight operations are given until ctx is done to
+// finish and are cancelled after that. Then the message handlers
+// are stopped, every peer connection is closed and Shutdown waits
+// for all the goroutines of the server and its transport to exit.
+//
+// Like for http.Server, the error of ctx is returned if it is done
+// before the server has stopped completely.
+func (s *FileServer) Shutdown (ctx context.Context) error {
+	s.opsLock.Lock()
+	s.stopping = true
+	s.opsLock.Unlock()
+
+	// let the operations in flight finish, cancel them once ctx is done
+	var err error
+	drained := waitGroupDone(&s.ops)
+	select {
+	case <- drained:
+	case <- ctx.Done():
+		err = ctx.Err()
+		s.cancelOps()
+		<- drained
+	}
+
+	s.stopOnce.Do(func () {
+		close(s.quitch)
+	})
+	s.connMgr.Close()
+	if tErr := s.Transport.Shutdown(ctx); tErr != nil {
+		err = tErr
+	}
+
+	stopped := make(chan struct{})
+	go func () {
+		s.routines.Wait()
+		s.workers.wait()
+		close(stopped)
+	}()
+	select {
+	case <- stopped:
+	case <- ctx.Done():
+		err = ctx.Err()
+	}
+	return err
+}
+
+func waitGroupDone (wg *sync.WaitGroup) <- chan struct{} {
+	done := make(chan struct{})
+	go func () {
+		wg.Wait()
+		close(done)
+	}()
+	return done
+}
@@ -2,12 +2,16 @@ package store
 
 import (
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/priyangshupal/distributed-file-system/crypto"
@@ -54,6 +58,20 @@ func (p *PathKey) firstPathName () string {
 	return paths[0]
 }
 
+// Meta is what the store records about a file when it is written,
+// next to the file in <filename>.meta
+type Meta struct {
+	// ID and Key are the ones the file was written with
+	ID string
+	Key string
+	Size int64
+	// Digest is the sha256 of the stored bytes
+	Digest []byte
+	// Version is given by the node owning the file to every write,
+	// so copies of the file can be ordered on every node
+	Version int64
+}
+
 type StoreOpts struct {
 	// Root is where all the files of a fileserver will be stored
 	Root string
@@ -106,7 +124,13 @@ func (s *Store) Delete (id string, key string) error {
 }
 
 func (s *Store) Write (id string, key string, r io.Reader) (int64, error) {
-	return s.writeStream(id, key, r)
+	return s.writeStream(id, key, 0, r)
+}
+
+// WriteVersion is like Write, but records the version of the file
+// given by its owner
+func (s *Store) WriteVersion (id string, key string, version int64, r io.Reader) (int64, error) {
+	return s.writeStream(id, key, version, r)
 }
 
 func (s *Store) WriteDecrypt (encKey []byte, id string, key string, r io.Reader) (int64, error) {
@@ -114,8 +138,9 @@ func (s *Store) WriteDecrypt (encKey []byte, id string, key string, r io.Reader)
 	if err != nil {
 		return 0, err
 	}
-	n, err := crypto.CopyDecrypt(encKey, r, f)
-	return int64(n), err
+	h := sha256.New()
+	n, err := crypto.CopyDecrypt(encKey, r, io.MultiWriter(f, h))
+	return int64(n), s.finishWrite(id, key, f, Meta{Size: int64(n), Digest: h.Sum(nil)}, err)
 }
 
 func (s *Store) openFileForWriting (id string, key string) (*os.File, error) {
@@ -129,15 +154,42 @@ func (s *Store) openFileForWriting (id string, key string) (*os.File, error) {
 
 	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.fullPath())
 
+	// the meta of the previous version is stale from now on
+	if err := os.Remove(s.metaPath(id, key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
 	return os.Create(fullPathWithRoot)
 }
 
-func (s *Store) writeStream (id string, key string, r io.Reader) (int64, error) {
+func (s *Store) writeStream (id string, key string, version int64, r io.Reader) (int64, error) {
 	f, err := s.openFileForWriting(id, key)
 	if err != nil {
 		return 0, err
 	}	
-	return io.Copy(f, r)
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), r)
+	return n, s.finishWrite(id, key, f, Meta{Size: n, Digest: h.Sum(nil), Version: version}, err)
+}
+
+// finishWrite closes the written file and records its meta once
+// the write succeeded. err is the error of the write.
+func (s *Store) finishWrite (id string, key string, f *os.File, meta Meta, err error) error {
+	if err := syncAndClose(f, err); err != nil {
+		return err
+	}
+	return s.writeMeta(id, key, meta)
+}
+
+// syncAndClose flushes a written file to disk, so it survives a crash
+// once a write returns, and closes it. err is the error of the write.
+func syncAndClose (f *os.File, err error) error {
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
 
 func (s *Store) Read (id string, key string) (int64, io.Reader, error) {
@@ -158,3 +210,78 @@ func (s *Store) readStream (id string, key string) (int64, io.ReadCloser, error)
 	}
 	return fi.Size(), file, nil
 }
+
+// Digest returns the size and the sha256 of the stored file, as
+// recorded when it was written. Files without a record are hashed.
+func (s *Store) Digest (id string, key string) (int64, []byte, error) {
+	if meta, err := s.Meta(id, key); err == nil {
+		return meta.Size, meta.Digest, nil
+	}
+	_, r, err := s.readStream(id, key)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer r.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	return n, h.Sum(nil), err
+}
+
+func (s *Store) metaPath (id string, key string) string {
+	pathKey := s.PathTransformFunc(key)
+	return fmt.Sprintf("%s/%s/%s.meta", s.Root, id, pathKey.fullPath())
+}
+
+// Meta returns what was recorded about the file when it was written
+func (s *Store) Meta (id string, key string) (Meta, error) {
+	var meta Meta
+	b, err := os.ReadFile(s.metaPath(id, key))
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(b, &meta)
+	return meta, err
+}
+
+// writeMeta writes the meta to a temporary file and renames it, so
+// a crash never leaves a half written record behind
+func (s *Store) writeMeta (id string, key string, meta Meta) error {
+	meta.ID, meta.Key = id, key
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	path := s.metaPath(id, key)
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".meta-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(b)
+	if err := syncAndClose(tmp, err); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Walk calls fn with the meta of every stored file. Files written
+// without a record are skipped.
+func (s *Store) Walk (fn func (Meta) error) error {
+	return filepath.WalkDir(s.Root, func (path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && strings.HasSuffix(path, ".meta") {
+			var b []byte
+			if b, err = os.ReadFile(path); err == nil {
+				var meta Meta
+				if err := json.Unmarshal(b, &meta); err != nil {
+					return fmt.Errorf("reading (%s): %w", path, err)
+				}
+				return fn(meta)
+			}
+		}
+		// files deleted meanwhile are skipped
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	})
+}
@@ -2,8 +2,11 @@ package store
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
+	"os"
 	"testing"
 
 	"github.com/priyangshupal/distributed-file-system/crypto"
@@ -30,7 +33,7 @@ func TestDelete (t *testing.T) {
 	id := crypto.GenerateID()
 	key := "mypicture"
 	data := []byte("some jpg bytes")
-	if _, err := s.writeStream(id, key, bytes.NewReader(data)); err != nil {
+	if _, err := s.writeStream(id, key, 0, bytes.NewReader(data)); err != nil {
 		t.Error(err)
 	}
 	if err := s.Delete(id, key); err != nil {
@@ -46,7 +49,7 @@ func TestStore(t *testing.T) {
 	for i := 0; i < 50; i++ {
 		key := fmt.Sprintf("foo_%d", i)
 		data := []byte("some jpg bytes")
-		if _, err := s.writeStream(id, key, bytes.NewReader(data)); err != nil {
+		if _, err := s.writeStream(id, key, 0, bytes.NewReader(data)); err != nil {
 			t.Error(err)
 		}
 
@@ -74,6 +77,44 @@ func TestStore(t *testing.T) {
 	}
 }
 
+func TestDigest (t *testing.T) {
+	s := newStore()
+	id := crypto.GenerateID()
+	defer tearDown(t, s)
+
+	data := []byte("some jpg bytes")
+	if _, err := s.WriteVersion(id, "mypicture", 42, bytes.NewReader(data)); err != nil {
+		t.Error(err)
+	}
+	if meta, err := s.Meta(id, "mypicture"); err != nil || meta.Version != 42 {
+		t.Errorf("have version (%d) expected (42), err: %v", meta.Version, err)
+	}
+	n, digest, err := s.Digest(id, "mypicture")
+	if err != nil {
+		t.Error(err)
+	}
+	expected := sha256.Sum256(data)
+	if n != int64(len(data)) || !bytes.Equal(digest, expected[:]) {
+		t.Errorf("have (%d) bytes with digest %x expected (%d) bytes with digest %x", n, digest, len(data), expected)
+	}
+
+	// the digest is the one recorded by the write, the file isn't hashed again
+	pathKey := s.PathTransformFunc("mypicture")
+	if err := os.WriteFile(fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.fullPath()), []byte("changed"), 0644); err != nil {
+		t.Error(err)
+	}
+	if _, recorded, _ := s.Digest(id, "mypicture"); !bytes.Equal(recorded, expected[:]) {
+		t.Errorf("have digest %x expected the recorded digest %x", recorded, expected)
+	}
+
+	if err := s.Delete(id, "mypicture"); err != nil {
+		t.Error(err)
+	}
+	if _, err := s.Meta(id, "mypicture"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the meta to be deleted with the file, got %v", err)
+	}
+}
+
 func newStore () *Store {
 	opts := StoreOpts{
 		PathTransformFunc: CASPathTransformFunc,
@@ -85,4 +126,33 @@ func tearDown (t *testing.T, s *Store) {
 	if err := s.clear(); err != nil {
 		t.Error(err)
 	}
-}
\ No newline at end of file
+}
+
+func TestWalk (t *testing.T) {
+	s := newStore()
+	defer tearDown(t, s)
+	if err := s.Walk(func (Meta) error { return nil }); err != nil {
+		t.Errorf("walking an empty store: %v", err)
+	}
+
+	id := crypto.GenerateID()
+	keys := map[string]bool{"first": true, "second": true}
+	for key := range keys {
+		if _, err := s.Write(id, key, bytes.NewReader([]byte(key))); err != nil {
+			t.Error(err)
+		}
+	}
+	err := s.Walk(func (meta Meta) error {
+		if meta.ID != id || !keys[meta.Key] || meta.Size != int64(len(meta.Key)) {
+			t.Errorf("unexpected meta %+v", meta)
+		}
+		delete(keys, meta.Key)
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if len(keys) > 0 {
+		t.Errorf("files %v were not walked", keys)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/priyangshupal/distributed-file-system/crypto"
+	"github.com/priyangshupal/distributed-file-system/dht"
+	"github.com/priyangshupal/distributed-file-system/p2p"
+)
+
+const tombstonesFile = "tombstones.json"
+
+// Tombstone records a deleted file until every node that may hold a
+// copy of it, see holders, has confirmed the delete. Nodes that were
+// offline get the delete once they reconnect.
+type Tombstone struct {
+	// ID is the node that stored the file, Key its hashed key
+	ID string
+	Key string
+	// Version is the version of the delete, the copies written by
+	// the owner before it are deleted
+	Version int64
+	DeletedAt time.Time
+	// Pending are the nodes that have not confirmed the delete yet
+	Pending []string
+}
+
+// confirmedBy tells whether the response of a node confirms the
+// delete. The node may have deleted the file, not had it, or kept a
+// copy the owner has written after the delete.
+func (t Tombstone) confirmedBy (payload any) error {
+	resp, ok := payload.(MessageDeleteFileResponse)
+	if !ok {
+		return fmt.Errorf("unexpected response %T to the delete of file (%s)", payload, t.Key)
+	}
+	if resp.Deleted || resp.Version == 0 || resp.Version > t.Version {
+		return nil
+	}
+	return fmt.Errorf("kept file (%s) with version (%d), which is not newer than the delete (%d)", t.Key, resp.Version, t.Version)
+}
+
+// tombstoneStore keeps the tombstones in a JSON file, so deletes
+// are not forgotten when the node restarts
+type tombstoneStore struct {
+	path string
+
+	mu sync.Mutex
+	tombstones map[string]*Tombstone
+}
+
+func tombstoneKey (id string, key string) string {
+	return id + "/" + key
+}
+
+// loadTombstones reads the tombstones saved at path, if there are any
+func loadTombstones (path string) (*tombstoneStore, error) {
+	ts := &tombstoneStore{path: path, tombstones: make(map[string]*Tombstone)}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ts, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []*Tombstone
+	if err := json.Unmarshal(b, &list); err != nil {
+		return nil, err
+	}
+	for _, t := range list {
+		ts.tombstones[tombstoneKey(t.ID, t.Key)] = t
+	}
+	return ts, nil
+}
+
+// add records the delete of a file that the pending nodes have to
+// confirm. Without pending nodes there is nothing to remember.
+func (ts *tombstoneStore) add (t Tombstone, pending []string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if len(pending) == 0 {
+		delete(ts.tombstones, tombstoneKey(t.ID, t.Key))
+	} else {
+		t.Pending = slices.Clone(pending)
+		ts.tombstones[tombstoneKey(t.ID, t.Key)] = &t
+	}
+	return ts.save()
+}
+
+// remove drops the tombstone of a file that has been stored again
+func (ts *tombstoneStore) remove (id string, key string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if _, ok := ts.tombstones[tombstoneKey(id, key)]; !ok {
+		return nil
+	}
+	delete(ts.tombstones, tombstoneKey(id, key))
+	return ts.save()
+}
+
+// confirm records that the node deleted the file. The tombstone is
+// dropped once every pending node has confirmed.
+func (ts *tombstoneStore) confirm (id string, key string, version int64, node string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	t, ok := ts.tombstones[tombstoneKey(id, key)]
+	// a confirmation for an older delete of the same file
+	if !ok || t.Version != version {
+		return nil
+	}
+	i := slices.Index(t.Pending, node)
+	if i < 0 {
+		return nil
+	}
+	t.Pending = slices.Delete(t.Pending, i, i + 1)
+	if len(t.Pending) == 0 {
+		delete(ts.tombstones, tombstoneKey(id, key))
+	}
+	return ts.save()
+}
+
+// retire drops the node from the tombstones, it is never going to
+// confirm them
+func (ts *tombstoneStore) retire (node string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	changed := false
+	for k, t := range ts.tombstones {
+		i := slices.Index(t.Pending, node)
+		if i < 0 {
+			continue
+		}
+		changed = true
+		t.Pending = slices.Delete(t.Pending, i, i + 1)
+		if len(t.Pending) == 0 {
+			delete(ts.tombstones, k)
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return ts.save()
+}
+
+// pending returns the tombstones the node has not confirmed yet
+func (ts *tombstoneStore) pending (node string) []Tombstone {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	list := []Tombstone{}
+	for _, t := range ts.tombstones {
+		if slices.Contains(t.Pending, node) {
+			list = append(list, *t)
+		}
+	}
+	return list
+}
+
+// list returns a copy of all the tombstones, oldest first
+func (ts *tombstoneStore) list () []Tombstone {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	list := make([]Tombstone, 0, len(ts.tombstones))
+	for _, t := range ts.tombstones {
+		c := *t
+		c.Pending = slices.Clone(t.Pending)
+		list = append(list, c)
+	}
+	sort.Slice(list, func (i, j int) bool {
+		return list[i].DeletedAt.Before(list[j].DeletedAt)
+	})
+	return list
+}
+
+// save writes the tombstones to a temporary file and renames it, so
+// a crash never leaves a half written file behind
+func (ts *tombstoneStore) save () error {
+	list := make([]*Tombstone, 0, len(ts.tombstones))
+	for _, t := range ts.tombstones {
+		list = append(list, t)
+	}
+	b, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(ts.path), os.ModePerm); err != nil {
+		return err
+	}
+	tmp := ts.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, ts.path)
+}
+
+const defaultTombstoneInterval = time.Minute
+
+// holders returns the nodes that may hold a copy of the file: its
+// replicas on the ring and the nodes that announced it in the DHT,
+// which may be offline right now
+func (s *FileServer) holders (ctx context.Context, key string) []string {
+	nodes := []string{}
+	for _, id := range s.ring.Lookup(placementKey(s.ID, key), s.ReplicationFactor) {
+		if id != s.ID {
+			nodes = append(nodes, id)
+		}
+	}
+	providers, err := s.dht.FindProviders(ctx, fileID(s.ID, crypto.HashKey(key)))
+	if err != nil && !errors.Is(err, dht.ErrNoContacts) {
+		log.Printf("[%s] looking up the providers of file (%s) failed: %v", s.Transport.Addr(), key, err)
+	}
+	for _, c := range providers {
+		if id := c.ID.String(); id != s.ID && !slices.Contains(nodes, id) {
+			nodes = append(nodes, id)
+		}
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// RetireNode forgets a node that is gone for good: it is no longer
+// dialed and the deletes it has not confirmed are not kept for it
+func (s *FileServer) RetireNode (id string) error {
+	for _, st := range s.connMgr.States() {
+		if st.ID == id {
+			s.connMgr.Remove(st.Addr)
+		}
+	}
+	s.dht.Remove(nodeID(id))
+	return s.tombstones.retire(id)
+}
+
+// catchUp sends the peer the deletes it has not confirmed yet, when
+// it reconnects and every now and then
+func (s *FileServer) catchUp (p p2p.Peer) {
+	tombstones := s.tombstones.pending(p.ID())
+	if len(tombstones) == 0 {
+		return
+	}
+	s.goOp(func (ctx context.Context) {
+		for _, t := range tombstones {
+			if err := s.sendDelete(ctx, p, t); err != nil {
+				log.Printf("[%s] catching up %s on deleted file (%s) failed: %v", s.Transport.Addr(), p.ID(), t.Key, err)
+				return
+			}
+		}
+	})
+}
+
+// sendDelete sends the delete of the tombstone to the peer and
+// records its confirmation
+func (s *FileServer) sendDelete (ctx context.Context, p p2p.Peer, t Tombstone) error {
+	req := s.newRequest(ctx, 1)
+	defer s.finishRequest(req)
+	msg := Message{
+		RequestID: req.id,
+		Payload: MessageDeleteFile{ID: t.ID, Key: t.Key, Version: t.Version},
+	}
+	if err := s.send(p, &msg); err != nil {
+		return err
+	}
+	responses, err := s.awaitResponses(ctx, req, []string{p.ID()})
+	if err != nil {
+		return err
+	}
+	if err := responseErr(responses[p.ID()]); err != nil {
+		return err
+	}
+	if err := t.confirmedBy(responses[p.ID()]); err != nil {
+		return err
+	}
+	return s.tombstones.confirm(t.ID, t.Key, t.Version, p.ID())
+}
+
+// tombstoneLoop sends the deletes again to the connected peers that
+// did not confirm them
+func (s *FileServer) tombstoneLoop () {
+	defer s.routines.Done()
+	ticker := time.NewTicker(defaultTombstoneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <- ticker.C:
+		case <- s.quitch:
+			return
+		}
+		for _, p := range s.peers.snapshot() {
+			s.catchUp(p)
+		}
+	}
+}
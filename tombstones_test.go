@@ -0,0 +1,69 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTombstoneStore (t *testing.T) {
+	path := filepath.Join(t.TempDir(), tombstonesFile)
+	ts, err := loadTombstones(path)
+	assert.Nil(t, err)
+	deletedAt := time.Now()
+	assert.Nil(t, ts.add(Tombstone{ID: "node", Key: "key", Version: 2, DeletedAt: deletedAt}, []string{"a", "b"}))
+	assert.Nil(t, ts.add(Tombstone{ID: "node", Key: "other", Version: 2, DeletedAt: deletedAt}, nil))
+	assert.Len(t, ts.list(), 1)
+
+	// a confirmation for an older delete is ignored
+	assert.Nil(t, ts.confirm("node", "key", 1, "a"))
+	assert.Len(t, ts.pending("a"), 1)
+	assert.Nil(t, ts.confirm("node", "key", 2, "a"))
+	assert.Empty(t, ts.pending("a"))
+	assert.Len(t, ts.pending("b"), 1)
+
+	// the tombstones survive a restart
+	ts, err = loadTombstones(path)
+	assert.Nil(t, err)
+	list := ts.list()
+	assert.Len(t, list, 1)
+	assert.Equal(t, []string{"b"}, list[0].Pending)
+	assert.True(t, list[0].DeletedAt.Equal(deletedAt))
+	assert.Equal(t, int64(2), list[0].Version)
+
+	// the last confirmation drops the tombstone
+	assert.Nil(t, ts.confirm("node", "key", list[0].Version, "b"))
+	assert.Empty(t, ts.list())
+	ts, err = loadTombstones(path)
+	assert.Nil(t, err)
+	assert.Empty(t, ts.list())
+}
+
+func TestTombstoneConfirmedBy (t *testing.T) {
+	tombstone := Tombstone{ID: "node", Key: "key", Version: 2}
+	assert.Nil(t, tombstone.confirmedBy(MessageDeleteFileResponse{Deleted: true}))
+	// the node did not have the file
+	assert.Nil(t, tombstone.confirmedBy(MessageDeleteFileResponse{}))
+	// the node kept a copy written after the delete
+	assert.Nil(t, tombstone.confirmedBy(MessageDeleteFileResponse{Version: 3}))
+	// but not one written before it
+	assert.NotNil(t, tombstone.confirmedBy(MessageDeleteFileResponse{Version: 2}))
+	assert.NotNil(t, tombstone.confirmedBy(MessageDeleteFileResponse{Version: 1}))
+	// a response of another type confirms nothing
+	assert.NotNil(t, tombstone.confirmedBy(MessageStoreFileResponse{}))
+}
+
+func TestTombstoneStoreRetire (t *testing.T) {
+	ts, err := loadTombstones(filepath.Join(t.TempDir(), tombstonesFile))
+	assert.Nil(t, err)
+	assert.Nil(t, ts.add(Tombstone{ID: "node", Key: "key", Version: 1}, []string{"a", "gone"}))
+	assert.Nil(t, ts.add(Tombstone{ID: "node", Key: "other", Version: 1}, []string{"gone"}))
+
+	// the node that is gone no longer holds back any tombstone
+	assert.Nil(t, ts.retire("gone"))
+	list := ts.list()
+	assert.Len(t, list, 1)
+	assert.Equal(t, []string{"a"}, list[0].Pending)
+}
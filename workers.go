@@ -0,0 +1,159 @@
+package main
+
+import (
+	"sync"
+)
+
+const (
+	defaultWorkers = 16
+	defaultWorkerQueueSize = 1024
+)
+
+// WorkerPoolStats describe the load of the message handlers
+type WorkerPoolStats struct {
+	Workers int
+	QueueSize int
+	// Queued is the number of messages waiting for a worker
+	Queued int
+	// Busy is the number of workers handling a message
+	Busy int
+}
+
+type poolJob struct {
+	orderKey string
+	run func()
+}
+
+// workerPool handles the incoming messages concurrently. Any free
+// worker takes the next runnable job. Jobs with the same order key
+// wait in a queue of their own, the next one only becomes runnable
+// once the previous one is done, so a slow job only holds up the jobs
+// with its key.
+type workerPool struct {
+	workers int
+	queueSize int
+
+	mu sync.Mutex
+	// cond wakes up the workers waiting for a runnable job, room
+	// the submitter waiting for the queue to drain
+	cond *sync.Cond
+	room *sync.Cond
+	runnable []poolJob
+	// keys holds the jobs waiting behind the runnable or running
+	// job of every order key
+	keys map[string][]poolJob
+	queued int
+	busy int
+	closed bool
+	wg sync.WaitGroup
+}
+
+func newWorkerPool (workers, queueSize int, quitch <- chan struct{}) *workerPool {
+	p := &workerPool{
+		workers: workers,
+		queueSize: queueSize,
+		keys: make(map[string][]poolJob),
+	}
+	p.cond = sync.NewCond(&p.mu)
+	p.room = sync.NewCond(&p.mu)
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go p.work()
+	}
+	go func () {
+		<- quitch
+		p.mu.Lock()
+		p.closed = true
+		p.cond.Broadcast()
+		p.room.Broadcast()
+		p.mu.Unlock()
+	}()
+	return p
+}
+
+// submit queues the job, waiting while the queue is full. Meanwhile
+// the messages pile up in the inbound queues of the peers, where the
+// overflow policy of every peer applies. Jobs with the same order key
+// are run one after the other in the order they were submitted, jobs
+// without one by any free worker. It returns false once the pool is
+// closed.
+func (p *workerPool) submit (orderKey string, job func()) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.queued >= p.queueSize && !p.closed {
+		p.room.Wait()
+	}
+	if p.closed {
+		return false
+	}
+	p.queued++
+	j := poolJob{orderKey: orderKey, run: job}
+	if len(orderKey) > 0 {
+		if waiting, ok := p.keys[orderKey]; ok {
+			p.keys[orderKey] = append(waiting, j)
+			return true
+		}
+		p.keys[orderKey] = nil
+	}
+	p.runnable = append(p.runnable, j)
+	p.cond.Signal()
+	return true
+}
+
+func (p *workerPool) work () {
+	defer p.wg.Done()
+	for {
+		p.mu.Lock()
+		for len(p.runnable) == 0 && !p.closed {
+			p.cond.Wait()
+		}
+		if p.closed {
+			p.mu.Unlock()
+			return
+		}
+		j := p.runnable[0]
+		p.runnable = p.runnable[1:]
+		p.queued--
+		p.room.Signal()
+		p.busy++
+		p.mu.Unlock()
+
+		j.run()
+
+		p.mu.Lock()
+		p.busy--
+		if len(j.orderKey) > 0 {
+			p.next(j.orderKey)
+		}
+		p.mu.Unlock()
+	}
+}
+
+// next makes the job waiting behind the finished one with the same
+// order key runnable
+func (p *workerPool) next (orderKey string) {
+	waiting := p.keys[orderKey]
+	if len(waiting) == 0 {
+		delete(p.keys, orderKey)
+		return
+	}
+	p.runnable = append(p.runnable, waiting[0])
+	p.keys[orderKey] = waiting[1:]
+	p.cond.Signal()
+}
+
+// wait blocks until every worker has exited
+func (p *workerPool) wait () {
+	p.wg.Wait()
+}
+
+func (p *workerPool) stats () WorkerPoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return WorkerPoolStats{
+		Workers: p.workers,
+		QueueSize: p.queueSize,
+		Queued: p.queued,
+		Busy: p.busy,
+	}
+}
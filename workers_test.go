@@ -0,0 +1,117 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkerPoolOrdering (t *testing.T) {
+	quitch := make(chan struct{})
+	defer close(quitch)
+	p := newWorkerPool(4, 64, quitch)
+
+	// a long running job only holds up the jobs with the same key
+	release := make(chan struct{})
+	p.submit("peer/slow", func () { <- release })
+	assert.Eventually(t, func () bool {
+		return p.stats().Busy == 1
+	}, time.Second, time.Millisecond)
+	done := make(chan struct{})
+	p.submit("", func () { close(done) })
+	select {
+	case <- done:
+	case <- time.After(time.Second):
+		t.Fatal("unordered job waited for a busy worker")
+	}
+	assert.Equal(t, 1, p.stats().Busy)
+	close(release)
+
+	var (
+		mu sync.Mutex
+		order []int
+		wg sync.WaitGroup
+	)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		p.submit("peer/key", func () {
+			defer wg.Done()
+			mu.Lock()
+			defer mu.Unlock()
+			order = append(order, i)
+		})
+	}
+	wg.Wait()
+	for i := range order {
+		assert.Equal(t, i, order[i])
+	}
+}
+
+func TestWorkerPoolKeysShareWorkers (t *testing.T) {
+	quitch := make(chan struct{})
+	defer close(quitch)
+	p := newWorkerPool(2, 4, quitch)
+
+	// while a job of one key runs, the other worker takes the
+	// jobs of all the other keys
+	release := make(chan struct{})
+	p.submit("peer/slow", func () { <- release })
+	assert.Eventually(t, func () bool {
+		return p.stats().Busy == 1
+	}, time.Second, time.Millisecond)
+	p.submit("peer/slow", func () {})
+	var wg sync.WaitGroup
+	for _, key := range []string{"peer/a", "peer/b", "peer/c"} {
+		wg.Add(1)
+		assert.True(t, p.submit(key, wg.Done))
+	}
+	wg.Wait()
+	assert.Equal(t, 1, p.stats().Queued)
+
+	// once the queue is full, submitting waits for room instead of
+	// dropping the job
+	for i := 0; i < 3; i++ {
+		assert.True(t, p.submit("peer/slow", func () {}))
+	}
+	assert.Equal(t, 4, p.stats().Queued)
+	submitted := make(chan bool)
+	ran := make(chan struct{})
+	go func () {
+		submitted <- p.submit("peer/d", func () { close(ran) })
+	}()
+	select {
+	case <- submitted:
+		t.Fatal("submitted a job to a full queue")
+	case <- time.After(time.Millisecond * 50):
+	}
+
+	close(release)
+	assert.True(t, <- submitted)
+	<- ran
+	assert.Eventually(t, func () bool {
+		stats := p.stats()
+		return stats.Queued == 0 && stats.Busy == 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestWorkerPoolClose (t *testing.T) {
+	quitch := make(chan struct{})
+	p := newWorkerPool(1, 1, quitch)
+	release := make(chan struct{})
+	defer close(release)
+	p.submit("", func () { <- release })
+	assert.Eventually(t, func () bool {
+		return p.stats().Busy == 1
+	}, time.Second, time.Millisecond)
+	p.submit("", func () {})
+
+	// a submit waiting for room gives up once the pool is closed
+	submitted := make(chan bool)
+	go func () {
+		submitted <- p.submit("", func () {})
+	}()
+	close(quitch)
+	assert.False(t, <- submitted)
+}